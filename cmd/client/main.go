@@ -1,28 +1,62 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/gg-tools/remotecommand/internal"
 )
 
+// Exit code used when the exit status of the remote command is not known, like ssh does
+const connectionLostExitCode = 255
+
 func main() {
+	token := flag.String("token", os.Getenv("REMOTECOMMAND_TOKEN"), "token to authenticate with, defaults to $REMOTECOMMAND_TOKEN")
+	caFile := flag.String("ca", "", "CA bundle to verify the server certificate with, instead of the system CAs")
+	certFile := flag.String("cert", "", "client certificate, for the servers requiring one")
+	keyFile := flag.String("key", "", "key of the client certificate")
+	serverName := flag.String("server-name", "", "name to verify the server certificate against, instead of the host of the URL")
+	sendEnv := flag.String("send-env", strings.Join(internal.DefaultSendEnv, ","), "environment variables to send to the server, the ones it accepts are set for the command")
 	flag.Parse()
 	args := flag.Args()
 	if len(args) != 1 {
-		fmt.Println("usage: client [service address]")
+		fmt.Println("usage: client [-token token] [-ca file] [-cert file -key file] [-server-name name] [-send-env names] [service address]")
 		return
 	}
 
 	connectURL := args[0]
 	client := internal.NewTtyShareClient(connectURL, "ctrl-c")
+	client.SetToken(*token)
+	if *sendEnv == "" {
+		client.SetSendEnv(nil)
+	} else {
+		client.SetSendEnv(strings.Split(*sendEnv, ","))
+	}
+	tlsConfig, err := internal.NewClientTLSConfig(*caFile, *certFile, *keyFile, *serverName)
+	if err != nil {
+		log.Fatalf("invalid TLS options: %s", err.Error())
+	}
+	client.SetTLSConfig(tlsConfig)
 
-	err := client.Run()
+	err = client.Run()
+	if errors.Is(err, internal.ErrJoinDenied) {
+		log.Println(err.Error())
+		os.Exit(connectionLostExitCode)
+	}
 	if err != nil {
 		log.Println("cannot connect to the remote session, make sure the URL points to a valid tty-share session.")
+		os.Exit(connectionLostExitCode)
 	}
 	log.Println("tty-share disconnected")
-	return
+
+	// Exit like the remote command did, so that the client can be used in scripts
+	code, ok := client.ExitCode()
+	if !ok {
+		os.Exit(connectionLostExitCode)
+	}
+	os.Exit(code)
 }
@@ -1,23 +1,60 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gg-tools/remotecommand/internal"
 	"github.com/gg-tools/remotecommand/internal/http"
 )
 
 func main() {
+	// Some of the commands of the sessions are started through the server binary
+	internal.CommandInit()
+
 	listenAddress := flag.String("listen", ":8022", "tty-server address")
+	configFile := flag.String("config", "", "JSON configuration file, with the command profiles the clients can use")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long the sessions are given to end on shutdown, before they are stopped")
 	flag.Parse()
 
-	// tty-share works as a server, from here on
-	if !internal.IsStdinTerminal() {
-		fmt.Printf("Input not a tty\n")
-		os.Exit(1)
+	config := http.DefaultConfig()
+	if *configFile != "" {
+		var err error
+		if config, err = http.LoadConfig(*configFile); err != nil {
+			log.Fatalf("cannot load the configuration: %s", err.Error())
+		}
+	}
+
+	// The sessions are not attached to the stdio of the server, so it can run as a daemon, without
+	// a controlling terminal (e.g.: under systemd or in a container)
+	server, err := http.NewServer(*listenAddress, config)
+	if err != nil {
+		log.Fatalf("cannot start the server: %s", err.Error())
 	}
 
-	_ = http.Serve(*listenAddress)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			os.Exit(1)
+		}
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("shutdown failed", err)
+		}
+		log.Println("Server stopped")
+	}
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gg-tools/remotecommand/internal/auth"
+	"github.com/gg-tools/remotecommand/internal/http"
+)
+
+// Issues the HMAC tokens the server accepts when configured with the same secret file
+func main() {
+	secretFile := flag.String("secret-file", "", "file holding the secret the tokens are signed with")
+	name := flag.String("name", "", "name of the identity the token is issued for")
+	role := flag.String("role", "", "role granted by the token: viewer or driver (default)")
+	ttl := flag.Duration("ttl", time.Hour, "how long the token is valid")
+	flag.Parse()
+
+	if *secretFile == "" || *name == "" {
+		log.Fatal("usage: token -secret-file file -name name [-role role] [-ttl duration]")
+	}
+	secret, err := http.ReadSecretFile(*secretFile)
+	if err != nil {
+		log.Fatalf("cannot read the secret: %s", err.Error())
+	}
+	token, err := auth.NewHMACTokens(secret).Sign(auth.Identity{Name: *name, Role: *role}, time.Now().Add(*ttl))
+	if err != nil {
+		log.Fatalf("cannot sign the token: %s", err.Error())
+	}
+	fmt.Println(token)
+}
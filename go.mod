@@ -7,5 +7,4 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/moby/term v0.0.0-20210619224110-3f7ff695adc6
-	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 )
@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// The types of the events
+const (
+	SessionCreated    = "session_created"
+	SessionTerminated = "session_terminated"
+	SessionEnded      = "session_ended"
+	JoinRequested     = "join_requested"
+	JoinDenied        = "join_denied"
+	ParticipantJoined = "participant_joined"
+	ParticipantLeft   = "participant_left"
+	ControlChanged    = "control_changed"
+	Resized           = "resized"
+	InputRuleMatched  = "input_rule_matched"
+	RequestRejected   = "request_rejected"
+)
+
+// Something which happened in a session, or to a request of the server. Only the fields which
+// make sense for its type are set.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Session string    `json:"session,omitempty"`
+
+	// The participant the event is about, or who caused it
+	Participant string `json:"participant,omitempty"`
+	Identity    string `json:"identity,omitempty"`
+	RemoteAddr  string `json:"remote_addr,omitempty"`
+	Role        string `json:"role,omitempty"`
+	Owner       bool   `json:"owner,omitempty"`
+
+	Profile string `json:"profile,omitempty"`
+	// The Unix account the command runs as
+	User   string `json:"user,omitempty"`
+	Target string `json:"target,omitempty"`
+	Pid    int    `json:"pid,omitempty"`
+
+	Cols int `json:"cols,omitempty"`
+	Rows int `json:"rows,omitempty"`
+
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	// How long the session, or the connection of the participant, lasted
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	// Received from, and sent to, the connection of the participant
+	BytesIn  *int64 `json:"bytes_in,omitempty"`
+	BytesOut *int64 `json:"bytes_out,omitempty"`
+
+	// The command line which matched an input rule, and what was done with it
+	Line   string `json:"line,omitempty"`
+	Action string `json:"action,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Where the events end up, e.g. an append-only file. Custom destinations (e.g.: a SIEM) are
+// plugged by implementing this interface.
+type Sink interface {
+	Write(event Event) error
+	Close() error
+}
+
+// Hands the events to all the sinks. A nil emitter drops the events.
+type Emitter struct {
+	sinks []Sink
+	// Held for reading while the events are written, so that Close waits for them
+	lock   sync.RWMutex
+	closed bool
+}
+
+func NewEmitter(sinks ...Sink) *Emitter {
+	return &Emitter{sinks: sinks}
+}
+
+// Timestamps the event, if it's not, and writes it to the sinks. The failures are logged: they
+// don't stop the sessions.
+func (e *Emitter) Emit(event Event) {
+	if e == nil || len(e.sinks) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.closed {
+		log.Printf("dropped the %s audit event of session %s: the audit log is closed", event.Type, event.Session)
+		return
+	}
+	for _, sink := range e.sinks {
+		if err := sink.Write(event); err != nil {
+			log.Printf("cannot write the %s audit event: %s", event.Type, err.Error())
+		}
+	}
+}
+
+// Closes the sinks. The events emitted afterwards are dropped, and logged.
+func (e *Emitter) Close() (err error) {
+	if e == nil {
+		return nil
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	for _, sink := range e.sinks {
+		if closeErr := sink.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return
+}
@@ -0,0 +1,44 @@
+package audit
+
+import "testing"
+
+type memorySink struct {
+	events []Event
+	closed int
+}
+
+func (s *memorySink) Write(event Event) error {
+	if s.closed > 0 {
+		panic("write to a closed sink")
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.closed++
+	return nil
+}
+
+func TestEmitterClose(t *testing.T) {
+	sink := &memorySink{}
+	emitter := NewEmitter(sink)
+	emitter.Emit(Event{Type: SessionCreated, Session: "s1"})
+	if err := emitter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	emitter.Emit(Event{Type: ParticipantLeft, Session: "s1"})
+	if err := emitter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.events) != 1 || sink.events[0].Type != SessionCreated {
+		t.Errorf("events = %+v, want only the one emitted before closing", sink.events)
+	}
+	if sink.events[0].Time.IsZero() {
+		t.Error("event not timestamped")
+	}
+	if sink.closed != 1 {
+		t.Errorf("sink closed %d times", sink.closed)
+	}
+}
@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// Writes the events as JSON lines, one per event
+type jsonLinesSink struct {
+	lock   sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// Appends the events to the file, which is created if needed. The file is never truncated nor
+// rewritten.
+func NewFileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonLinesSink{w: f, closer: f}, nil
+}
+
+// Writes the events to w, e.g. os.Stdout. w is not closed.
+func NewWriterSink(w io.Writer) Sink {
+	return &jsonLinesSink{w: w}
+}
+
+func (s *jsonLinesSink) Write(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	// In a single write, so that the lines of concurrent writers don't interleave
+	line = append(line, '\n')
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.w.Write(line)
+	return err
+}
+
+func (s *jsonLinesSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// The request doesn't carry any credentials this authenticator understands
+	ErrNoCredentials = errors.New("no credentials")
+	// The request carries credentials, but they are not valid
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Query parameter carrying the token, for the clients which can't set the headers of the WS
+// upgrade request (e.g.: browsers)
+const TokenQueryParam = "token"
+
+// Who the authenticated client is
+type Identity struct {
+	Name string
+	// What the client is allowed to do in the sessions (e.g.: "viewer"). Empty means no
+	// restriction.
+	Role string
+}
+
+// Authenticates the requests, before they are served. Custom authentication (e.g.: against an
+// external service) is plugged by implementing this interface.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type AuthenticatorFunc func(r *http.Request) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Identity, error) {
+	return f(r)
+}
+
+// Tries each of the authenticators, in order, until one of them accepts or rejects the request
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, authenticator := range c {
+		identity, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// The bearer token of the request, from the Authorization header or the token query parameter
+func BearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		const prefix = "bearer "
+		if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+			return strings.TrimSpace(header[len(prefix):])
+		}
+		return ""
+	}
+	return r.URL.Query().Get(TokenQueryParam)
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// The identity the request was authenticated with, nil if authentication is disabled
+func IdentityFrom(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// Authenticates the requests before they reach the handler, rejecting them with 401
+func Middleware(authenticator Authenticator, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := authenticator.Authenticate(r)
+		if err != nil || identity == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="remotecommand"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+	})
+}
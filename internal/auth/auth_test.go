@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func request(header, query string) *http.Request {
+	r := httptest.NewRequest("GET", "/"+query, nil)
+	if header != "" {
+		r.Header.Set("Authorization", header)
+	}
+	return r
+}
+
+func TestStaticTokens(t *testing.T) {
+	tokens := NewStaticTokens()
+	tokens.Add("s3cret-alice", Identity{Name: "alice"})
+	tokens.Add("s3cret-carol", Identity{Name: "carol", Role: "viewer"})
+
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		// Empty if not authenticated
+		identity Identity
+	}{
+		{"header", "Bearer s3cret-alice", "", Identity{Name: "alice"}},
+		{"lower case scheme", "bearer s3cret-carol", "", Identity{Name: "carol", Role: "viewer"}},
+		{"query parameter", "", "?token=s3cret-alice", Identity{Name: "alice"}},
+		{"header before the query parameter", "Bearer s3cret-carol", "?token=s3cret-alice", Identity{Name: "carol", Role: "viewer"}},
+		{"unknown token", "Bearer s3cret-bob", "", Identity{}},
+		{"prefix of a token", "Bearer s3cret", "", Identity{}},
+		{"token and more", "Bearer s3cret-alice2", "", Identity{}},
+		{"other scheme", "Basic s3cret-alice", "?token=s3cret-alice", Identity{}},
+		{"no token", "", "", Identity{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := tokens.Authenticate(request(test.header, test.query))
+			if test.identity.Name == "" {
+				if !errors.Is(err, ErrNoCredentials) {
+					t.Fatalf("error = %v, want no credentials", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if *identity != test.identity {
+				t.Errorf("identity = %+v, want %+v", identity, test.identity)
+			}
+		})
+	}
+}
+
+// Authenticates as the name, or fails with the error
+func fixed(name string, err error) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Identity, error) {
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{Name: name}, nil
+	})
+}
+
+func TestChain(t *testing.T) {
+	invalid := fmt.Errorf("%w: bad signature", ErrInvalidCredentials)
+	tests := []struct {
+		name  string
+		chain Chain
+		// Empty if not authenticated
+		identity string
+		err      error
+	}{
+		{"empty", Chain{}, "", ErrNoCredentials},
+		{"first", Chain{fixed("alice", nil), fixed("bob", nil)}, "alice", nil},
+		{"no credentials fall through", Chain{fixed("", ErrNoCredentials), fixed("bob", nil)}, "bob", nil},
+		{"invalid credentials stop", Chain{fixed("", invalid), fixed("bob", nil)}, "", ErrInvalidCredentials},
+		{"invalid after no credentials", Chain{fixed("", ErrNoCredentials), fixed("", invalid), fixed("bob", nil)}, "", ErrInvalidCredentials},
+		{"none has credentials", Chain{fixed("", ErrNoCredentials), fixed("", ErrNoCredentials)}, "", ErrNoCredentials},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := test.chain.Authenticate(request("", ""))
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("error = %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if identity.Name != test.identity {
+				t.Errorf("identity = %s, want %s", identity.Name, test.identity)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		authenticator Authenticator
+		status        int
+	}{
+		{"authenticated", fixed("alice", nil), http.StatusOK},
+		{"no credentials", fixed("", ErrNoCredentials), http.StatusUnauthorized},
+		{"invalid credentials", fixed("", ErrInvalidCredentials), http.StatusUnauthorized},
+		{"no identity", AuthenticatorFunc(func(r *http.Request) (*Identity, error) { return nil, nil }), http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			served := false
+			handler := Middleware(test.authenticator, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served = true
+				if identity := IdentityFrom(r.Context()); identity == nil || identity.Name != "alice" {
+					t.Errorf("identity = %+v, want alice", identity)
+				}
+			}))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request("", ""))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if served != (test.status == http.StatusOK) {
+				t.Errorf("served = %v", served)
+			}
+			if test.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Signs the raw payload, to craft the tokens Sign doesn't issue
+func signPayload(h *HMACTokens, payload string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(h.mac(encoded))
+}
+
+func TestHMACTokens(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	h := NewHMACTokens([]byte("secret"))
+	h.now = func() time.Time { return now }
+	sign := func(identity Identity, expiresAt time.Time) string {
+		token, err := h.Sign(identity, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := sign(Identity{Name: "alice", Role: "viewer"}, now.Add(time.Minute))
+	payload := strings.Split(valid, ".")[0]
+	foreign, err := NewHMACTokens([]byte("other")).Sign(Identity{Name: "alice"}, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		// Empty if the token is valid
+		err string
+		// Whether the token is not even of this kind
+		noCredentials bool
+	}{
+		{"valid", valid, "", false},
+		{"no token", "", "", true},
+		{"static token", "s3cret", "", true},
+		{"too many parts", valid + ".x", "", true},
+		{"signed with another secret", foreign, "bad signature", false},
+		{"tampered payload", base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"root","exp":1700000060}`)) + "." + strings.Split(valid, ".")[1], "bad signature", false},
+		{"signature not base64url", payload + ".!!!", "bad signature", false},
+		{"signature base64 with padding", payload + "." + base64.URLEncoding.EncodeToString(h.mac(payload)), "bad signature", false},
+		{"payload not base64url", "!!!." + base64.RawURLEncoding.EncodeToString(h.mac("!!!")), "bad payload", false},
+		{"payload not JSON", signPayload(h, "alice"), "bad payload", false},
+		{"no subject", signPayload(h, `{"exp":1700000060}`), "bad payload", false},
+		{"expired", sign(Identity{Name: "alice"}, now.Add(-time.Second)), "token expired", false},
+		{"expires now", sign(Identity{Name: "alice"}, now), "token expired", false},
+		{"no expiry", signPayload(h, `{"sub":"alice"}`), "token without expiry", false},
+		{"zero expiry", signPayload(h, `{"sub":"alice","exp":0}`), "token without expiry", false},
+		{"negative expiry", signPayload(h, `{"sub":"alice","exp":-1}`), "token without expiry", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+			identity, err := h.Authenticate(r)
+			switch {
+			case test.noCredentials:
+				if !errors.Is(err, ErrNoCredentials) {
+					t.Fatalf("error = %v, want no credentials", err)
+				}
+			case test.err != "":
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Fatalf("error = %v, want invalid credentials", err)
+				}
+				if !strings.Contains(err.Error(), test.err) {
+					t.Errorf("error = %q, want it to mention %q", err, test.err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if *identity != (Identity{Name: "alice", Role: "viewer"}) {
+					t.Errorf("unexpected identity: %+v", identity)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// Authenticates the requests with a fixed list of bearer tokens, each mapped to an identity
+type StaticTokens struct {
+	tokens []staticToken
+}
+
+type staticToken struct {
+	token    []byte
+	identity Identity
+}
+
+func NewStaticTokens() *StaticTokens {
+	return &StaticTokens{}
+}
+
+func (s *StaticTokens) Add(token string, identity Identity) {
+	s.tokens = append(s.tokens, staticToken{
+		token:    []byte(token),
+		identity: identity,
+	})
+}
+
+func (s *StaticTokens) Authenticate(r *http.Request) (*Identity, error) {
+	token := BearerToken(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+
+	// Compare against all the tokens in constant time, not to leak which one almost matched
+	var found *Identity
+	for i := range s.tokens {
+		if subtle.ConstantTimeCompare(s.tokens[i].token, []byte(token)) == 1 {
+			identity := s.tokens[i].identity
+			found = &identity
+		}
+	}
+	if found == nil {
+		return nil, ErrNoCredentials
+	}
+	return found, nil
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The cgroup v2 group the sessions get theirs in, when not configured otherwise
+const DefaultCgroupParent = "/sys/fs/cgroup/remotecommand"
+
+// Limits the resources the processes of a cgroup can use together. The zero values mean no limit.
+type CgroupLimits struct {
+	// How many CPUs worth of time, e.g.: 1.5
+	CPUs float64
+	// In bytes
+	Memory int64
+	Pids   int
+}
+
+// The resources the processes of a cgroup use
+type CgroupUsage struct {
+	CPUTime time.Duration
+	// In bytes
+	Memory int64
+	Pids   int
+}
+
+// A cgroup v2 group, holding the processes of a session
+type Cgroup struct {
+	path string
+}
+
+// Creates the group name in the parent group, with the limits. The parent group is created if
+// needed, and the controllers needed for the limits are enabled in it and in its own parent.
+func NewCgroup(parent, name string, limits CgroupLimits) (*Cgroup, error) {
+	var controllers []string
+	if limits.CPUs > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if limits.Memory > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if limits.Pids > 0 {
+		controllers = append(controllers, "pids")
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{filepath.Dir(parent), parent} {
+		if err := enableControllers(dir, controllers); err != nil {
+			return nil, err
+		}
+	}
+
+	cg := &Cgroup{path: filepath.Join(parent, name)}
+	if err := os.Mkdir(cg.path, 0755); err != nil {
+		return nil, err
+	}
+	if err := cg.setLimits(limits); err != nil {
+		cg.Remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+func enableControllers(dir string, controllers []string) error {
+	if len(controllers) == 0 {
+		return nil
+	}
+	enable := "+" + strings.Join(controllers, " +")
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(enable), 0); err != nil {
+		return fmt.Errorf("cannot enable the %s controllers in %s: %w", strings.Join(controllers, ", "), dir, err)
+	}
+	return nil
+}
+
+func (cg *Cgroup) setLimits(limits CgroupLimits) error {
+	const cpuPeriod = 100000 // microseconds
+
+	if limits.CPUs > 0 {
+		quota := int64(limits.CPUs * cpuPeriod)
+		if err := cg.write("cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			return err
+		}
+	}
+	if limits.Memory > 0 {
+		if err := cg.write("memory.max", strconv.FormatInt(limits.Memory, 10)); err != nil {
+			return err
+		}
+		// Kill the session rather than letting it swap the host to a crawl
+		if err := cg.write("memory.swap.max", "0"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if limits.Pids > 0 {
+		if err := cg.write("pids.max", strconv.Itoa(limits.Pids)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cg *Cgroup) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(cg.path, file), []byte(value), 0); err != nil {
+		return fmt.Errorf("cannot set %s of %s: %w", file, cg.path, err)
+	}
+	return nil
+}
+
+func (cg *Cgroup) Path() string {
+	return cg.path
+}
+
+// Moves the process in the group. The processes it starts afterwards are in the group too.
+func (cg *Cgroup) Add(pid int) error {
+	return cg.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// What the processes of the group use. The usages of the controllers which are not enabled are
+// left to 0.
+func (cg *Cgroup) Usage() (usage CgroupUsage, err error) {
+	// Present in all the groups, unlike the files of the controllers
+	stat, err := os.Open(filepath.Join(cg.path, "cpu.stat"))
+	if err != nil {
+		return
+	}
+	defer stat.Close()
+	scanner := bufio.NewScanner(stat)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usec, _ := strconv.ParseInt(fields[1], 10, 64)
+			usage.CPUTime = time.Duration(usec) * time.Microsecond
+		}
+	}
+
+	if memory, err := cg.readInt("memory.current"); err == nil {
+		usage.Memory = memory
+	}
+	if pids, err := cg.readInt("pids.current"); err == nil {
+		usage.Pids = int(pids)
+	} else {
+		usage.Pids = len(cg.Pids())
+	}
+	return usage, nil
+}
+
+// The processes in the group
+func (cg *Cgroup) Pids() []int {
+	procs, err := os.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(procs)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+func (cg *Cgroup) readInt(file string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(cg.path, file))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Removes the group, once its processes are gone. The kernel might take a little while to
+// release the processes which were just killed.
+func (cg *Cgroup) Remove() (err error) {
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(cg.path); err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
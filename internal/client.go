@@ -1,13 +1,21 @@
 package internal
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/gg-tools/remotecommand/internal/tty"
 	"github.com/gorilla/websocket"
@@ -15,8 +23,25 @@ import (
 	"log"
 )
 
+// Returned by Run when no owner of the session let the client in
+var ErrJoinDenied = errors.New("not let in the session")
+
+// Header of the WS upgrade response carrying the ID of the session the connection was attached to
+const SessionIDHeader = "X-Session-Id"
+
+// Header of the WS upgrade request carrying an environment variable for the command: NAME=value
+const SessionEnvHeader = "X-Session-Env"
+
+// The environment variables the client sends, unless told otherwise. Like the SendEnv of ssh, the
+// server only sets the ones it accepts.
+var DefaultSendEnv = []string{"TERM", "COLORTERM", "LANG", "LANGUAGE", "LC_*", "TZ"}
+
 type ttyShareClient struct {
 	url          string
+	token        string
+	tlsConfig    *tls.Config
+	sendEnv      []string
+	sessionID    string
 	wsConn       *websocket.Conn
 	detachKeys   string
 	wcChan       chan os.Signal
@@ -28,6 +53,17 @@ type ttyShareClient struct {
 		remoteH uint16
 	}
 	winSizesMutex sync.Mutex
+	// The exit status of the remote command, if the server has sent it
+	exitStatus struct {
+		received bool
+		code     int
+		signal   string
+	}
+	// The connections waiting for us to let them in, when we own the session
+	joinLock     sync.Mutex
+	joinRequests []tty.JoinRequest
+	// Why we were not let in the session, if that's the case
+	joinDenied string
 }
 
 func NewTtyShareClient(url string, detachKeys string) *ttyShareClient {
@@ -35,6 +71,7 @@ func NewTtyShareClient(url string, detachKeys string) *ttyShareClient {
 		url:          url,
 		wsConn:       nil,
 		detachKeys:   detachKeys,
+		sendEnv:      DefaultSendEnv,
 		wcChan:       make(chan os.Signal, 1),
 		ioFlagAtomic: 1,
 	}
@@ -44,6 +81,158 @@ func clearScreen() {
 	fmt.Fprintf(os.Stdout, "\033[H\033[2J")
 }
 
+// Shows a message from the server, on its own line
+func showNotice(text string) {
+	fmt.Fprintf(os.Stdout, "\r\n\033[7m[remotecommand] %s\033[0m\r\n", text)
+}
+
+// Shows a line at the top of the screen, over the output of the session
+func showOverlay(text string) {
+	fmt.Fprintf(os.Stdout, "\0337\033[1;1H\033[2K\033[7m[remotecommand] %s\033[0m\0338", text)
+}
+
+func clearOverlay() {
+	fmt.Fprintf(os.Stdout, "\0337\033[1;1H\033[2K\0338")
+}
+
+// Shows the first of the connections waiting to be let in. Redrawn after each output, so that
+// it stays visible until it's decided.
+func (c *ttyShareClient) updateJoinOverlay(requests []tty.JoinRequest) {
+	c.joinLock.Lock()
+	shown := len(c.joinRequests) > 0
+	if requests != nil {
+		c.joinRequests = requests
+	}
+	requests = c.joinRequests
+	c.joinLock.Unlock()
+
+	if len(requests) == 0 {
+		if shown {
+			clearOverlay()
+		}
+		return
+	}
+	text := fmt.Sprintf("%s asks to join as %s. Ctrl-] a: let in, Ctrl-] d: turn away", requests[0].Name, requests[0].Role)
+	if len(requests) > 1 {
+		text += fmt.Sprintf(" (%d more waiting)", len(requests)-1)
+	}
+	showOverlay(text)
+}
+
+// Lets in, or turns away, the first of the connections waiting to join
+func (c *ttyShareClient) decideJoin(protoWS *tty.TTYProtocolWSLocked, approve bool) {
+	c.joinLock.Lock()
+	defer c.joinLock.Unlock()
+	if len(c.joinRequests) == 0 {
+		showNotice("Nobody is waiting to join.")
+		return
+	}
+	protoWS.DecideJoin(c.joinRequests[0].ID, approve)
+}
+
+// Asks the server for a link letting someone else join the session with the role, and shows it
+func (c *ttyShareClient) shareLink(role tty.Role) {
+	link, err := c.createShareLink(role)
+	if err != nil {
+		showNotice("Cannot create a share link: " + err.Error())
+		return
+	}
+	showNotice(fmt.Sprintf("Share link (%s, until %s): %s", role, link.ExpiresAt.Local().Format("15:04"), link.URL))
+}
+
+type shareLinkResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Error     string    `json:"error"`
+}
+
+func (c *ttyShareClient) createShareLink(role tty.Role) (*shareLinkResponse, error) {
+	if c.sessionID == "" {
+		return nil, errors.New("the server didn't tell the ID of the session")
+	}
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = fmt.Sprintf("/api/sessions/%s/links", c.sessionID)
+	u.RawQuery = ""
+
+	body, err := json.Marshal(map[string]string{"role": string(role)})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	httpClient := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: c.tlsConfig},
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var link shareLinkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&link); err != nil {
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, errors.New(link.Error)
+	}
+	return &link, nil
+}
+
+// The key prefixing the commands of the client: Ctrl-]
+const commandKey = 0x1d
+
+// Intercepts the commands typed by the user: the commandKey followed by the key of a command.
+// Typing the commandKey twice sends it to the remote side.
+type commandKeyReader struct {
+	wrappedReader io.Reader
+	commands      map[byte]func()
+	pending       bool
+}
+
+func (r *commandKeyReader) Read(data []byte) (n int, err error) {
+	for {
+		read, err := r.wrappedReader.Read(data)
+		n = 0
+		for _, b := range data[:read] {
+			if r.pending {
+				r.pending = false
+				if b != commandKey {
+					if command, ok := r.commands[b]; ok {
+						command()
+					}
+					continue
+				}
+			} else if b == commandKey {
+				r.pending = true
+				continue
+			}
+			data[n] = b
+			n++
+		}
+		// Don't return empty reads when all the input was made of commands
+		if n > 0 || read == 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
 type keyListener struct {
 	wrappedReader io.Reader
 	ioFlagAtomicP *uint32
@@ -91,13 +280,74 @@ func (c *ttyShareClient) updateThisWinSize() {
 	}
 }
 
+// Sets the token the client authenticates with
+func (c *ttyShareClient) SetToken(token string) {
+	c.token = token
+}
+
+// Sets the environment variables sent to the server, by name. The names can end with a "*" to send
+// all the variables with that prefix.
+func (c *ttyShareClient) SetSendEnv(names []string) {
+	c.sendEnv = names
+}
+
+// Sets the TLS configuration used to connect to wss:// URLs
+func (c *ttyShareClient) SetTLSConfig(tlsConfig *tls.Config) {
+	c.tlsConfig = tlsConfig
+}
+
+// The URL through which other clients can join the session this client is attached to
+func (c *ttyShareClient) JoinURL() string {
+	u, err := url.Parse(c.url)
+	if err != nil || c.sessionID == "" {
+		return c.url
+	}
+	u.Path = fmt.Sprintf("/s/%s/ws", c.sessionID)
+	u.RawQuery = ""
+	return u.String()
+}
+
+// The variables of our environment matching the ones to send
+func (c *ttyShareClient) envToSend() []string {
+	var variables []string
+	for _, variable := range os.Environ() {
+		name := strings.SplitN(variable, "=", 2)[0]
+		for _, pattern := range c.sendEnv {
+			if prefix := strings.TrimSuffix(pattern, "*"); name == pattern || (prefix != pattern && strings.HasPrefix(name, prefix)) {
+				variables = append(variables, variable)
+				break
+			}
+		}
+	}
+	return variables
+}
+
 func (c *ttyShareClient) Run() (err error) {
 	log.Printf("Connecting as a client to %s ..", c.url)
 
-	c.wsConn, _, err = websocket.DefaultDialer.Dial(c.url, nil)
+	header := http.Header{}
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+	for _, variable := range c.envToSend() {
+		header.Add(SessionEnvHeader, variable)
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = c.tlsConfig
+	var resp *http.Response
+	c.wsConn, resp, err = dialer.Dial(c.url, header)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			log.Println("The server rejected the credentials, check the -token option")
+		}
+		if resp != nil && resp.StatusCode == http.StatusConflict {
+			log.Println("No owner of the session is connected to let you in, try again once one is")
+		}
 		return
 	}
+	if c.sessionID = resp.Header.Get(SessionIDHeader); c.sessionID != "" {
+		log.Printf("Attached to session %s. Others can join it with: %s", c.sessionID, c.JoinURL())
+	}
 
 	detachBytes, err := term.ToBytes(c.detachKeys)
 	if err != nil {
@@ -111,6 +361,10 @@ func (c *ttyShareClient) Run() (err error) {
 
 	protoWS := tty.NewTTYProtocolWSLocked(c.wsConn)
 
+	// The remote window is sized after the clients: let the session know about our size
+	c.updateThisWinSize()
+	protoWS.SetWinSize(int(c.winSizes.thisW), int(c.winSizes.thisH))
+
 	monitorWinChanges := func() {
 		// start monitoring the size of the terminal
 		signal.Notify(c.wcChan, syscall.SIGWINCH)
@@ -129,15 +383,14 @@ func (c *ttyShareClient) Run() (err error) {
 
 		var err error
 		for {
-			err = protoWS.ReadAndHandle(
-				// onWrite
-				func(data []byte) {
+			err = protoWS.ReadAndHandle(tty.MsgHandlers{
+				OnWrite: func(data []byte) {
 					if atomic.LoadUint32(&c.ioFlagAtomic) != 0 {
 						os.Stdout.Write(data)
+						c.updateJoinOverlay(nil)
 					}
 				},
-				// onWindowSize
-				func(cols, rows int) {
+				OnWinSize: func(cols, rows int) {
 					c.winSizesMutex.Lock()
 					c.winSizes.remoteW = uint16(cols)
 					c.winSizes.remoteH = uint16(rows)
@@ -145,7 +398,45 @@ func (c *ttyShareClient) Run() (err error) {
 					c.updateThisWinSize()
 					c.updateAndDecideStdoutMuted()
 				},
-			)
+				OnNotice: func(text string) {
+					showNotice(text)
+				},
+				OnDriver: func(driver string, you bool) {
+					switch {
+					case you:
+						showNotice("You are driving the session.")
+					case driver == "":
+						showNotice("Nobody is driving the session. Press Ctrl-] r to take the control.")
+					default:
+						showNotice(fmt.Sprintf("%s is driving the session. Press Ctrl-] r to request the control.", driver))
+					}
+				},
+				OnJoinRequests: func(requests []tty.JoinRequest) {
+					c.updateJoinOverlay(requests)
+				},
+				OnJoinStatus: func(status, reason string) {
+					switch status {
+					case tty.JoinPending:
+						showNotice(reason)
+					case tty.JoinApproved:
+						clearScreen()
+						showNotice("You were let in the session.")
+					case tty.JoinDenied:
+						c.joinDenied = reason
+						showNotice(reason)
+					}
+				},
+				OnRole: func(role tty.Role) {
+					if role == tty.RoleViewer {
+						showNotice("You joined as a viewer: you can watch the session, but your input is ignored.")
+					}
+				},
+				OnExit: func(code int, signal string) {
+					c.exitStatus.received = true
+					c.exitStatus.code = code
+					c.exitStatus.signal = signal
+				},
+			})
 
 			if err != nil {
 				log.Printf("Error parsing remote message: %s", err.Error())
@@ -158,8 +449,47 @@ func (c *ttyShareClient) Run() (err error) {
 	}
 
 	writeLoop := func() {
-		kl := &keyListener{
+		commands := &commandKeyReader{
 			wrappedReader: term.NewEscapeProxy(os.Stdin, detachBytes),
+			commands: map[byte]func(){
+				'e': func() {
+					protoWS.Extend()
+				},
+				'r': func() {
+					protoWS.Control(tty.ControlRequest, "")
+				},
+				'g': func() {
+					protoWS.Control(tty.ControlGrant, "")
+				},
+				'x': func() {
+					protoWS.Control(tty.ControlRelease, "")
+				},
+				'v': func() {
+					protoWS.Control(tty.ControlRevoke, "")
+				},
+				'a': func() {
+					c.decideJoin(protoWS, true)
+				},
+				'd': func() {
+					c.decideJoin(protoWS, false)
+				},
+				'l': func() {
+					go c.shareLink(tty.RoleViewer)
+				},
+				'L': func() {
+					go c.shareLink(tty.RoleDriver)
+				},
+				'?': func() {
+					showNotice("Commands: Ctrl-] followed by e: extend the session, r: request the control, " +
+						"g: grant the control to who asked for it, x: release the control, " +
+						"v: take the control back (owners), a/d: let in/turn away who asks to join (owners), " +
+						"l/L: print a link to join as a viewer/driver (owners), " +
+						"Ctrl-]: send Ctrl-]")
+				},
+			},
+		}
+		kl := &keyListener{
+			wrappedReader: commands,
 			ioFlagAtomicP: &c.ioFlagAtomic,
 		}
 		_, err := io.Copy(protoWS, kl)
@@ -176,9 +506,21 @@ func (c *ttyShareClient) Run() (err error) {
 	readLoop()
 
 	clearScreen()
+	if c.joinDenied != "" {
+		err = fmt.Errorf("%w: %s", ErrJoinDenied, c.joinDenied)
+	}
 	return
 }
 
+// The exit code of the remote command. ok is false if the connection was closed without the
+// server sending it.
+func (c *ttyShareClient) ExitCode() (code int, ok bool) {
+	if c.exitStatus.received && c.exitStatus.signal != "" {
+		log.Printf("Remote command terminated by signal: %s", c.exitStatus.signal)
+	}
+	return c.exitStatus.code, c.exitStatus.received
+}
+
 func (c *ttyShareClient) Stop() {
 	c.wsConn.Close()
 	signal.Stop(c.wcChan)
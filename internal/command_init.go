@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// The commands which need more than what exec.Cmd can do are started through the binary of the
+// server itself, re-executed under this name: the command init. It waits for the server to be
+// done with it (e.g.: to put it in its cgroup), sets up what it's asked to (e.g.: the sandbox),
+// then execs the command in place of itself. See CommandInit.
+const commandInitArg0 = "remotecommand-init"
+
+// Environment variable through which the command init gets the command to exec
+const commandSpecEnv = "REMOTECOMMAND_INIT_SPEC"
+
+// The file descriptor of the command init the server closes once it's ready
+const commandGateFd = 3
+
+// What the command init needs to know to exec the command
+type commandSpec struct {
+	Argv       []string
+	Arg0       string
+	Dir        string
+	Credential *syscall.Credential
+	Sandbox    *Sandbox
+}
+
+func needsInit(command Command) bool {
+	return command.Sandbox != nil || command.Cgroup != nil || command.JoinCgroup != "" || len(command.Rlimits) > 0
+}
+
+// The command starting the command init, and the gate to close for it to exec the command. The
+// credential is switched to by the command init, once it's done with what needs privileges.
+func initCommand(command Command) (*exec.Cmd, *os.File, error) {
+	spec, err := json.Marshal(commandSpec{
+		Argv:       command.Argv,
+		Arg0:       command.Arg0,
+		Dir:        command.Dir,
+		Credential: command.Credential,
+		Sandbox:    command.Sandbox,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	gateReader, gateWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args = []string{commandInitArg0}
+	cmd.Env = append(command.Env, commandSpecEnv+"="+string(spec))
+	cmd.ExtraFiles = []*os.File{gateReader}
+	return cmd, gateWriter, nil
+}
+
+// Lets the command init exec the command, or makes it exit if ready is false
+func openGate(gateWriter *os.File, ready bool) {
+	if ready {
+		gateWriter.Write([]byte{1})
+	}
+	gateWriter.Close()
+}
+
+// To be called first thing by the main function of the server. When the process was started as
+// a command init, it execs the command of the session in place of the process once it's set up,
+// so it never returns. It does nothing otherwise.
+func CommandInit() {
+	if len(os.Args) == 0 || os.Args[0] != commandInitArg0 {
+		return
+	}
+	err := runCommandInit()
+	// The output goes to the PTY, so the participants see why the session ended right away
+	fmt.Fprintf(os.Stderr, "cannot start the command: %s\r\n", err.Error())
+	os.Exit(127)
+}
+
+func runCommandInit() error {
+	gate := os.NewFile(commandGateFd, "gate")
+	ready := make([]byte, 1)
+	if _, err := io.ReadFull(gate, ready); err != nil {
+		return errors.New("the server gave up on the command")
+	}
+	gate.Close()
+
+	var spec commandSpec
+	if err := json.Unmarshal([]byte(os.Getenv(commandSpecEnv)), &spec); err != nil {
+		return err
+	}
+	os.Unsetenv(commandSpecEnv)
+	if len(spec.Argv) == 0 {
+		return errors.New("no command to start")
+	}
+
+	if spec.Sandbox != nil {
+		if err := spec.Sandbox.setup(); err != nil {
+			return fmt.Errorf("cannot set the sandbox up: %w", err)
+		}
+	}
+	if cred := spec.Credential; cred != nil {
+		if err := syscall.Setgroups(intIDs(cred.Groups)); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(int(cred.Gid)); err != nil {
+			return err
+		}
+		if err := syscall.Setuid(int(cred.Uid)); err != nil {
+			return err
+		}
+	}
+	if spec.Dir != "" {
+		if err := os.Chdir(spec.Dir); err != nil {
+			return err
+		}
+	}
+
+	// Looked up once set up: in a sandbox, the command might not be at the same place as on
+	// the host
+	path, err := exec.LookPath(spec.Argv[0])
+	if err != nil {
+		return err
+	}
+	argv := append([]string{}, spec.Argv...)
+	if spec.Arg0 != "" {
+		argv[0] = spec.Arg0
+	}
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+func intIDs(ids []uint32) []int {
+	ints := make([]int, len(ids))
+	for i, id := range ids {
+		ints[i] = int(id)
+	}
+	return ints
+}
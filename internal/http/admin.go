@@ -0,0 +1,72 @@
+package http
+
+import (
+	"github.com/gg-tools/remotecommand/internal/tty"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+)
+
+const drainingNotice = "The server is draining for a restart: please finish your work, no new sessions can be started."
+
+// JSON endpoints to administrate the server
+type AdminAPI struct {
+	shell *WSShell
+}
+
+func NewAdminAPI(shell *WSShell) *AdminAPI {
+	return &AdminAPI{
+		shell: shell,
+	}
+}
+
+type drainStatus struct {
+	Draining bool `json:"draining"`
+	Sessions int  `json:"sessions"`
+}
+
+func (a *AdminAPI) Register(m *mux.Router) {
+	m.HandleFunc("/api/admin/drain", a.requireAdmin(a.DrainStatus)).Methods("GET")
+	m.HandleFunc("/api/admin/drain", a.requireAdmin(a.StartDrain)).Methods("POST")
+	m.HandleFunc("/api/admin/drain", a.requireAdmin(a.StopDrain)).Methods("DELETE")
+}
+
+func (a *AdminAPI) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.shell.isAdmin(r) || requestRole(r) != tty.RoleDriver {
+			writeError(w, http.StatusForbidden, "only the admins are allowed to do that")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (a *AdminAPI) DrainStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.status())
+}
+
+// Puts the server in drain mode: the running sessions are left alone, but no new ones can be
+// started. Used for rolling restarts, the server can be restarted once there are no sessions left.
+func (a *AdminAPI) StartDrain(w http.ResponseWriter, r *http.Request) {
+	if !a.shell.Draining() {
+		log.Println("Draining: no new sessions are accepted")
+		a.shell.Drain(true)
+		a.shell.notifyAll(drainingNotice)
+	}
+	writeJSON(w, http.StatusOK, a.status())
+}
+
+func (a *AdminAPI) StopDrain(w http.ResponseWriter, r *http.Request) {
+	if a.shell.Draining() {
+		log.Println("Not draining anymore: new sessions are accepted")
+		a.shell.Drain(false)
+	}
+	writeJSON(w, http.StatusOK, a.status())
+}
+
+func (a *AdminAPI) status() drainStatus {
+	return drainStatus{
+		Draining: a.shell.Draining(),
+		Sessions: len(a.shell.sessions.list()),
+	}
+}
@@ -0,0 +1,348 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gg-tools/remotecommand/internal/audit"
+	"github.com/gg-tools/remotecommand/internal/tty"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// JSON endpoints to manage the lifecycle of the sessions served by a WSShell
+type SessionAPI struct {
+	shell *WSShell
+}
+
+func NewSessionAPI(shell *WSShell) *SessionAPI {
+	return &SessionAPI{
+		shell: shell,
+	}
+}
+
+type createSessionRequest struct {
+	Profile string            `json:"profile"`
+	Target  string            `json:"target"`
+	Cols    int               `json:"cols"`
+	Rows    int               `json:"rows"`
+	Env     map[string]string `json:"env"`
+}
+
+type createLinkRequest struct {
+	// "viewer" or "driver". Defaults to "viewer".
+	Role string `json:"role"`
+	// Defaults to 1 hour
+	ExpiresIn Duration `json:"expires_in"`
+	OneUse    bool     `json:"one_use"`
+	// Who the link is for, as shown to the participants of the session
+	Name string `json:"name"`
+}
+
+type shareLinkInfo struct {
+	shareLink
+	Token string `json:"token"`
+	// The URL the clients join the session with
+	URL string `json:"url"`
+}
+
+type windowSize struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+}
+
+type sessionInfo struct {
+	ID           string                `json:"id"`
+	Profile      string                `json:"profile"`
+	Owner        string                `json:"owner,omitempty"`
+	User         string                `json:"user,omitempty"`
+	Target       string                `json:"target,omitempty"`
+	Pid          int                   `json:"pid"`
+	StartedAt    time.Time             `json:"started_at"`
+	WindowSize   windowSize            `json:"window_size"`
+	Env          map[string]string     `json:"env,omitempty"`
+	WSPath       string                `json:"ws_path"`
+	LastActivity time.Time             `json:"last_activity"`
+	ExpiresAt    *time.Time            `json:"expires_at,omitempty"`
+	Participants []tty.ParticipantInfo `json:"participants"`
+	// What the processes of the session use, if it has resource limits
+	Resources *resourceUsage `json:"resources,omitempty"`
+}
+
+type resourceUsage struct {
+	CPUTime     Duration `json:"cpu_time"`
+	MemoryBytes int64    `json:"memory_bytes"`
+	Pids        int      `json:"pids"`
+}
+
+func (a *SessionAPI) Register(m *mux.Router) {
+	m.HandleFunc("/api/sessions", requireDriver(a.Create)).Methods("POST")
+	m.HandleFunc("/api/sessions", a.List).Methods("GET")
+	m.HandleFunc("/api/sessions/{id}", a.Inspect).Methods("GET")
+	m.HandleFunc("/api/sessions/{id}", requireDriver(a.Terminate)).Methods("DELETE")
+	m.HandleFunc("/api/sessions/{id}/extend", requireDriver(a.Extend)).Methods("POST")
+	m.HandleFunc("/api/sessions/{id}/links", requireDriver(a.CreateLink)).Methods("POST")
+	m.HandleFunc("/api/sessions/{id}/links", requireDriver(a.Links)).Methods("GET")
+	m.HandleFunc("/api/sessions/{id}/links/{link}", requireDriver(a.RevokeLink)).Methods("DELETE")
+	m.HandleFunc("/api/profiles", a.Profiles).Methods("GET")
+}
+
+// Lists the names of the profiles the sessions can be created with
+func (a *SessionAPI) Profiles(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"default":  a.shell.config.DefaultProfile,
+		"profiles": profileNames(a.shell.config.Profiles),
+	})
+}
+
+func (a *SessionAPI) Create(w http.ResponseWriter, r *http.Request) {
+	var req createSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if req.Cols < 0 || req.Rows < 0 {
+		writeError(w, http.StatusBadRequest, "invalid window size")
+		return
+	}
+
+	sess, err := a.shell.newSession(sessionOptions{
+		Profile: req.Profile,
+		Target:  req.Target,
+		Owner:   identityName(r),
+		// Its creator connects to it next
+		ClaimOwner: true,
+		Client:     a.shell.rateLimitKey(r),
+		Cols:       req.Cols,
+		Rows:       req.Rows,
+		Env:        req.Env,
+	})
+	if err != nil {
+		a.shell.rejected(r, err)
+		setRetryAfter(w, err)
+		writeError(w, sessionErrorStatus(err), "cannot create session: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, a.describe(r, sess))
+}
+
+func (a *SessionAPI) List(w http.ResponseWriter, r *http.Request) {
+	infos := []sessionInfo{}
+	for _, sess := range a.shell.sessions.list() {
+		infos = append(infos, a.describe(r, sess))
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a *SessionAPI) Inspect(w http.ResponseWriter, r *http.Request) {
+	sess, ok := a.shell.sessions.get(mux.Vars(r)["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.describe(r, sess))
+}
+
+func (a *SessionAPI) Terminate(w http.ResponseWriter, r *http.Request) {
+	sess, ok := a.ownedSession(w, r)
+	if !ok {
+		return
+	}
+	log.Printf("Terminating session %s", sess.id)
+	a.shell.audit.Emit(audit.Event{
+		Type:       audit.SessionTerminated,
+		Session:    sess.id,
+		Identity:   identityName(r),
+		RemoteAddr: r.RemoteAddr,
+		Reason:     "terminated through the API",
+	})
+	// Returns once the command has been reaped. The session gets unregistered once the
+	// command's output is closed.
+	sess.pty.Stop()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Pushes the max lifetime of a session, as many times as its profile allows it
+func (a *SessionAPI) Extend(w http.ResponseWriter, r *http.Request) {
+	sess, ok := a.ownedSession(w, r)
+	if !ok {
+		return
+	}
+	if _, err := a.shell.extendSession(sess); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, a.describe(r, sess))
+}
+
+// Mints a share link to the session, for its owners and the admins
+func (a *SessionAPI) CreateLink(w http.ResponseWriter, r *http.Request) {
+	sess, ok := a.ownedSession(w, r)
+	if !ok {
+		return
+	}
+	req := createLinkRequest{Role: string(tty.RoleViewer), ExpiresIn: Duration(defaultShareLinkTTL)}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	role, err := tty.ParseRole(req.Role)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.ExpiresIn <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid expires_in")
+		return
+	}
+
+	link, token, err := a.shell.links.mint(shareLink{
+		Session:   sess.id,
+		Role:      role,
+		Name:      req.Name,
+		Expires:   time.Now().Add(time.Duration(req.ExpiresIn)),
+		OneUse:    req.OneUse,
+		CreatedBy: identityName(r),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Share link %s to session %s minted for the %s role, until %s", link.ID, sess.id, role, link.Expires.Format(time.RFC3339))
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	writeJSON(w, http.StatusCreated, shareLinkInfo{
+		shareLink: *link,
+		Token:     token,
+		URL:       fmt.Sprintf("%s://%s/s/%s/ws?%s=%s", scheme, r.Host, sess.id, shareLinkParam, token),
+	})
+}
+
+// Lists the share links to the session which can still be used. Their tokens are not included.
+func (a *SessionAPI) Links(w http.ResponseWriter, r *http.Request) {
+	sess, ok := a.ownedSession(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.shell.links.list(sess.id))
+}
+
+func (a *SessionAPI) RevokeLink(w http.ResponseWriter, r *http.Request) {
+	sess, ok := a.ownedSession(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["link"]
+	if !a.shell.links.revoke(sess.id, id) {
+		writeError(w, http.StatusNotFound, "share link not found")
+		return
+	}
+	log.Printf("Share link %s to session %s revoked", id, sess.id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The session of the request, if it's owned by the identity of the request or if that identity is
+// an admin. Anyone owns the sessions without authentication.
+func (a *SessionAPI) ownedSession(w http.ResponseWriter, r *http.Request) (*session, bool) {
+	sess, ok := a.shell.sessions.get(mux.Vars(r)["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "session not found")
+		return nil, false
+	}
+	if !a.shell.manages(r, sess) {
+		writeError(w, http.StatusForbidden, "only the owner of the session, or an admin, can do that")
+		return nil, false
+	}
+	return sess, true
+}
+
+// Describes the session to the request. The environment, which can hold secrets set by the
+// profile, is only shown to the owner of the session and to the admins.
+func (a *SessionAPI) describe(r *http.Request, sess *session) sessionInfo {
+	info := describeSession(sess)
+	if !a.shell.manages(r, sess) {
+		info.Env = nil
+	}
+	return info
+}
+
+func describeSession(sess *session) sessionInfo {
+	cols, rows := sess.session.LastWindowSize()
+	var expiresAt *time.Time
+	if deadline := sess.limits.expiresAt(); !deadline.IsZero() {
+		expiresAt = &deadline
+	}
+	var resources *resourceUsage
+	if usage, err := sess.pty.Usage(); err != nil {
+		log.Printf("cannot read the resource usage of session %s: %s", sess.id, err.Error())
+	} else if usage != nil {
+		resources = &resourceUsage{
+			CPUTime:     Duration(usage.CPUTime),
+			MemoryBytes: usage.Memory,
+			Pids:        usage.Pids,
+		}
+	}
+	return sessionInfo{
+		ID:           sess.id,
+		Profile:      sess.profile,
+		Owner:        sess.owner,
+		User:         sess.user,
+		Target:       sess.target,
+		Pid:          sess.pty.Pid(),
+		StartedAt:    sess.pty.StartedAt(),
+		WindowSize:   windowSize{Cols: cols, Rows: rows},
+		Env:          sess.env,
+		WSPath:       fmt.Sprintf("/s/%s/ws", sess.id),
+		LastActivity: sess.session.LastActivity(),
+		ExpiresAt:    expiresAt,
+		Participants: sess.session.Participants(),
+		Resources:    resources,
+	}
+}
+
+// Rejects the requests of the viewers, which are not allowed to change anything
+func requireDriver(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestRole(r) != tty.RoleDriver {
+			writeError(w, http.StatusForbidden, "viewers are not allowed to do that")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Whether the request was authenticated as one of the admins. Without authentication, everyone is
+// an admin.
+func (s *WSShell) isAdmin(r *http.Request) bool {
+	identity := identityName(r)
+	if identity == "" {
+		return true
+	}
+	for _, admin := range s.config.Auth.Admins {
+		if admin == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the request was authenticated as the owner of the session, or as an admin
+func (s *WSShell) manages(r *http.Request, sess *session) bool {
+	return identityName(r) == sess.owner || s.isAdmin(r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("cannot write response: ", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
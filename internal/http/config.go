@@ -0,0 +1,316 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gg-tools/remotecommand/internal"
+	"github.com/gg-tools/remotecommand/internal/audit"
+	"github.com/gg-tools/remotecommand/internal/auth"
+	"github.com/gg-tools/remotecommand/internal/tty"
+	"os"
+	"time"
+)
+
+// Configuration of the server, usually loaded from a JSON file
+type Config struct {
+	// The command profiles the clients can choose from, by name
+	Profiles map[string]*CommandProfile `json:"profiles"`
+	// The profile used when the client doesn't ask for one
+	DefaultProfile string `json:"default_profile"`
+	// How the clients are authenticated. When nothing is configured, anyone can connect.
+	Auth AuthConfig `json:"auth"`
+	// Serve over TLS, when a certificate is configured
+	TLS TLSConfig `json:"tls"`
+	// Maps the identities to the Unix accounts their sessions run as, in the profiles with
+	// user_from_identity. The identities not listed run as the account with their name.
+	Users map[string]string `json:"users"`
+	// The lowest UID the identities not listed in users can run as, so that an identity named
+	// after a system account doesn't get it. Root is always refused. Defaults to 1000.
+	MinUID uint32 `json:"min_uid"`
+	// The cgroup v2 group in which the sessions with resource limits get theirs. Defaults to
+	// /sys/fs/cgroup/remotecommand.
+	CgroupParent string `json:"cgroup_parent"`
+	// Which environment variables the commands get, from the server and from the clients
+	Env EnvConfig `json:"env"`
+	// Where the audit events of the sessions are written
+	Audit AuditConfig `json:"audit"`
+	// Protects the host from the clients starting, or connecting to, too many sessions
+	Limits ServerLimits `json:"limits"`
+
+	// Custom authentication, tried after the authenticators configured in Auth
+	Authenticator auth.Authenticator `json:"-"`
+	// Custom destinations of the audit events, next to the ones configured in Audit
+	AuditSinks []audit.Sink `json:"-"`
+}
+
+type AuthConfig struct {
+	// Fixed bearer tokens
+	Tokens []TokenConfig `json:"tokens"`
+	// File holding the secret the HMAC tokens are signed with
+	HMACSecretFile string `json:"hmac_secret_file"`
+	// The identities which can manage all the sessions, and the server. The others can only
+	// manage the sessions they own. Without authentication, everyone can.
+	Admins []string `json:"admins"`
+}
+
+// The zero values mean no limit
+type ServerLimits struct {
+	// Maximum number of sessions running at the same time, all the profiles together
+	MaxSessions int `json:"max_sessions"`
+	// Maximum number of connections attached to a session at the same time, including the ones
+	// waiting to be let in. The owners of the session can always join it.
+	MaxParticipants int `json:"max_participants"`
+	// How often each client can start a session
+	SessionRate RateLimit `json:"session_rate"`
+	// How often each client can open a WS connection, to start or to join a session
+	ConnectRate RateLimit `json:"connect_rate"`
+	// "identity" to count the rates per identity, and per IP address for the requests which are
+	// not authenticated. "ip" to count them per IP address. Defaults to "identity".
+	RateLimitBy string `json:"rate_limit_by"`
+}
+
+const (
+	rateLimitByIdentity = "identity"
+	rateLimitByIP       = "ip"
+)
+
+type RateLimit struct {
+	PerMinute float64 `json:"per_minute"`
+	// How many can be done in a row, after a quiet period. Defaults to per_minute.
+	Burst int `json:"burst"`
+}
+
+func (l *ServerLimits) validate() error {
+	if l.MaxSessions < 0 || l.MaxParticipants < 0 {
+		return errors.New("limits: invalid max_sessions or max_participants")
+	}
+	for _, rate := range []RateLimit{l.SessionRate, l.ConnectRate} {
+		if rate.PerMinute < 0 || rate.Burst < 0 {
+			return errors.New("limits: invalid rate")
+		}
+	}
+	switch l.RateLimitBy {
+	case "", rateLimitByIdentity, rateLimitByIP:
+	default:
+		return fmt.Errorf("limits: rate_limit_by must be %s or %s", rateLimitByIdentity, rateLimitByIP)
+	}
+	return nil
+}
+
+// The events are written as JSON lines, one per event
+type AuditConfig struct {
+	// Files the events are appended to
+	Files []string `json:"files"`
+	// Write the events to the standard output too, e.g. for a log collector
+	Stdout bool `json:"stdout"`
+}
+
+type TokenConfig struct {
+	Token string `json:"token"`
+	Name  string `json:"name"`
+	// "viewer" to only let the token watch the sessions. Defaults to "driver".
+	Role string `json:"role"`
+}
+
+// A duration which is written as a string in JSON, e.g.: "1m30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Profiles:       defaultProfiles(),
+		DefaultProfile: defaultProfile,
+		CgroupParent:   internal.DefaultCgroupParent,
+	}
+}
+
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &Config{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %s", path, err.Error())
+	}
+	if len(cfg.Profiles) == 0 {
+		cfg.Profiles = defaultProfiles()
+	}
+	if cfg.DefaultProfile == "" {
+		cfg.DefaultProfile = defaultProfile
+	}
+	if cfg.CgroupParent == "" {
+		cfg.CgroupParent = internal.DefaultCgroupParent
+	}
+	return cfg, cfg.validate()
+}
+
+func (cfg *Config) validate() error {
+	for name, profile := range cfg.Profiles {
+		if profile == nil {
+			return fmt.Errorf("profile %s is empty", name)
+		}
+		if err := profile.validate(name); err != nil {
+			return err
+		}
+		for variable := range profile.Env {
+			if cfg.Env.scrubbed(variable) {
+				return fmt.Errorf("profile %s: the environment variable %s is scrubbed", name, variable)
+			}
+		}
+	}
+	if err := cfg.Env.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Limits.validate(); err != nil {
+		return err
+	}
+	if err := cfg.TLS.validate(); err != nil {
+		return err
+	}
+	for i, token := range cfg.Auth.Tokens {
+		if token.Token == "" || token.Name == "" {
+			return fmt.Errorf("auth token #%d: both the token and the name are required", i+1)
+		}
+		if token.Role != "" {
+			if _, err := tty.ParseRole(token.Role); err != nil {
+				return fmt.Errorf("auth token #%d: %s", i+1, err.Error())
+			}
+		}
+	}
+	if _, ok := cfg.Profiles[cfg.DefaultProfile]; !ok {
+		return errors.New("the default profile is not configured: " + cfg.DefaultProfile)
+	}
+	return nil
+}
+
+// Returns the profile with the given name, or the default one if the name is empty. Only the
+// configured profiles are allowed.
+func (cfg *Config) profile(name string) (string, *CommandProfile, error) {
+	if name == "" {
+		name = cfg.DefaultProfile
+	}
+	profile, ok := cfg.Profiles[name]
+	if !ok {
+		return "", nil, fmt.Errorf("profile %s is not allowed, use one of %v", name, profileNames(cfg.Profiles))
+	}
+	return name, profile, nil
+}
+
+// The Unix account the command of the profile runs as, when started by the identity. Returns nil
+// if it runs as the user of the server.
+func (cfg *Config) account(profile *CommandProfile, identity string) (*account, error) {
+	name := profile.User
+	// Whether the account comes from the name of the identity, rather than from the configuration
+	fromIdentity := false
+	if profile.UserFromIdentity {
+		if identity == "" {
+			return nil, fmt.Errorf("%w: the profile runs as the account of the identity, which requires authentication", errNoAccount)
+		}
+		mapped, ok := cfg.Users[identity]
+		name, fromIdentity = mapped, !ok
+		if fromIdentity {
+			name = identity
+		}
+	}
+	if name == "" {
+		return nil, nil
+	}
+	acc, err := lookupAccount(name)
+	if err != nil {
+		return nil, err
+	}
+	minUID := cfg.MinUID
+	if minUID == 0 {
+		minUID = defaultMinUID
+	}
+	if fromIdentity && (acc.Uid == 0 || acc.Uid < minUID) {
+		return nil, fmt.Errorf("%w: %s is a system account, map the identity to it in users to allow it", errNoAccount, name)
+	}
+	return acc, nil
+}
+
+// Builds the authenticator of the server out of the configuration. Returns nil if no
+// authentication is configured.
+func (cfg *Config) authenticator() (auth.Authenticator, error) {
+	var chain auth.Chain
+
+	if len(cfg.Auth.Tokens) > 0 {
+		tokens := auth.NewStaticTokens()
+		for _, token := range cfg.Auth.Tokens {
+			tokens.Add(token.Token, auth.Identity{Name: token.Name, Role: token.Role})
+		}
+		chain = append(chain, tokens)
+	}
+	if cfg.Auth.HMACSecretFile != "" {
+		secret, err := ReadSecretFile(cfg.Auth.HMACSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, auth.NewHMACTokens(secret))
+	}
+	if cfg.Authenticator != nil {
+		chain = append(chain, cfg.Authenticator)
+	}
+
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// Builds the emitter of the audit events out of the configuration. The events are dropped if no
+// sink is configured.
+func (cfg *Config) auditEmitter() (*audit.Emitter, error) {
+	var sinks []audit.Sink
+	for _, path := range cfg.Audit.Files {
+		sink, err := audit.NewFileSink(path)
+		if err != nil {
+			for _, opened := range sinks {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("cannot open the audit log: %w", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if cfg.Audit.Stdout {
+		sinks = append(sinks, audit.NewWriterSink(os.Stdout))
+	}
+	sinks = append(sinks, cfg.AuditSinks...)
+	return audit.NewEmitter(sinks...), nil
+}
+
+// Reads a secret from a file, ignoring the surrounding white spaces
+func ReadSecretFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("the secret in %s is too short, it needs at least 16 bytes", path)
+	}
+	return secret, nil
+}
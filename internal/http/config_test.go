@@ -0,0 +1,51 @@
+package http
+
+import (
+	"errors"
+	"testing"
+)
+
+// Relies on the root, daemon (UID 1) and nobody (UID 65534) accounts found on most systems
+func TestConfigAccount(t *testing.T) {
+	fromIdentity := &CommandProfile{UserFromIdentity: true}
+	tests := []struct {
+		name     string
+		minUID   uint32
+		users    map[string]string
+		profile  *CommandProfile
+		identity string
+		// Empty if the session can't run
+		account string
+	}{
+		{"regular account", 0, nil, fromIdentity, "nobody", "nobody"},
+		{"root", 0, nil, fromIdentity, "root", ""},
+		{"root below the minimum", 1, nil, fromIdentity, "root", ""},
+		{"system account", 0, nil, fromIdentity, "daemon", ""},
+		{"system account above the minimum", 1, nil, fromIdentity, "daemon", "daemon"},
+		{"mapped to root", 0, map[string]string{"alice": "root"}, fromIdentity, "alice", "root"},
+		{"mapped to a system account", 0, map[string]string{"daemon": "daemon"}, fromIdentity, "daemon", "daemon"},
+		{"mapped to another account", 0, map[string]string{"alice": "nobody"}, fromIdentity, "alice", "nobody"},
+		{"root of the mapped identity", 0, map[string]string{"alice": "nobody"}, fromIdentity, "root", ""},
+		{"not authenticated", 0, nil, fromIdentity, "", ""},
+		{"unknown account", 0, nil, fromIdentity, "no-such-account", ""},
+		{"user of the profile", 0, nil, &CommandProfile{User: "root"}, "alice", "root"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{Users: test.users, MinUID: test.minUID}
+			acc, err := cfg.account(test.profile, test.identity)
+			if test.account == "" {
+				if !errors.Is(err, errNoAccount) {
+					t.Fatalf("error = %v, want no account", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if acc.Name != test.account {
+				t.Errorf("account = %s, want %s", acc.Name, test.account)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package http
+
+import (
+	"fmt"
+	"github.com/gg-tools/remotecommand/internal"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The variables of the server the commands get, when not configured otherwise
+var defaultInheritEnv = []string{"PATH", "LANG", "LANGUAGE", "LC_*", "TZ"}
+
+// The variables the clients can send, when not configured otherwise. Like the AcceptEnv of sshd.
+var defaultAcceptEnv = []string{"TERM", "COLORTERM", "LANG", "LANGUAGE", "LC_*", "TZ"}
+
+// The variables which never make it to the commands from the server or the clients: they change
+// what the programs load or run behind the back of the users
+var scrubbedEnv = []string{
+	"LD_*", "GCONV_PATH", "HOSTALIASES", "LOCALDOMAIN", "MALLOC_*", "NLSPATH", "RES_OPTIONS",
+	"BASH_ENV", "BASH_FUNC_*", "BASHOPTS", "ENV", "IFS", "PROMPT_COMMAND", "PS4", "SHELLOPTS",
+	"REMOTECOMMAND_*",
+}
+
+// The terminal the commands are told they run in, when the client doesn't tell
+const defaultTerm = "xterm-256color"
+
+// Which environment variables the commands of the sessions get. The names can end with a "*" to
+// match all the variables with that prefix, e.g. "LC_*".
+type EnvConfig struct {
+	// The variables of the server passed on to the commands. Defaults to PATH, LANG, LANGUAGE,
+	// LC_* and TZ.
+	Inherit []string `json:"inherit"`
+	// The variables the clients can set, through the "env" query parameter or the X-Session-Env
+	// header of the WS connection, or the env of the API. The others are ignored. Defaults to
+	// TERM, COLORTERM, LANG, LANGUAGE, LC_* and TZ.
+	Accept []string `json:"accept"`
+	// More variables to remove, on top of the ones which always are (e.g. LD_PRELOAD). They
+	// can't be set by the profiles.
+	Scrub []string `json:"scrub"`
+}
+
+func (cfg *EnvConfig) inherit() []string {
+	if cfg.Inherit == nil {
+		return defaultInheritEnv
+	}
+	return cfg.Inherit
+}
+
+func (cfg *EnvConfig) accept() []string {
+	if cfg.Accept == nil {
+		return defaultAcceptEnv
+	}
+	return cfg.Accept
+}
+
+func (cfg *EnvConfig) scrubbed(name string) bool {
+	return matchEnv(name, scrubbedEnv) || matchEnv(name, cfg.Scrub)
+}
+
+func (cfg *EnvConfig) validate() error {
+	for _, patterns := range [][]string{cfg.Inherit, cfg.Accept, cfg.Scrub} {
+		for _, pattern := range patterns {
+			if !validEnvName(strings.TrimSuffix(pattern, "*")) {
+				return fmt.Errorf("env: invalid variable name %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// The environment of the command of the profile, from the lowest to the highest precedence: the
+// variables inherited from the server, the ones of the account the command runs as, the ones sent
+// by the client and the ones fixed by the profile. The ones from the server and the client are
+// scrubbed.
+func (cfg *EnvConfig) environment(profile *CommandProfile, acc *account, client map[string]string) map[string]string {
+	env := map[string]string{"TERM": defaultTerm}
+	for _, variable := range os.Environ() {
+		name, value := splitEnv(variable)
+		if matchEnv(name, cfg.inherit()) && !cfg.scrubbed(name) {
+			env[name] = value
+		}
+	}
+	if acc != nil {
+		for _, variable := range acc.env() {
+			name, value := splitEnv(variable)
+			env[name] = value
+		}
+	}
+	var ignored []string
+	for name, value := range client {
+		if !validEnvName(name) || strings.IndexByte(value, 0) >= 0 || !matchEnv(name, cfg.accept()) || cfg.scrubbed(name) {
+			ignored = append(ignored, name)
+			continue
+		}
+		env[name] = value
+	}
+	if len(ignored) > 0 {
+		sort.Strings(ignored)
+		log.Printf("Ignoring the environment variables sent by the client: %s", strings.Join(ignored, ", "))
+	}
+	for name, value := range profile.Env {
+		env[name] = value
+	}
+	return env
+}
+
+// The variables of the environment, as in os.Environ, sorted by name
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for name, value := range env {
+		list = append(list, name+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func splitEnv(variable string) (string, string) {
+	if i := strings.IndexByte(variable, '='); i >= 0 {
+		return variable[:i], variable[i+1:]
+	}
+	return variable, ""
+}
+
+func matchEnv(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Letters, digits and underscores, not starting with a digit
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// The variables sent by the client with the WS connection: "NAME=value", in the "env" query
+// parameters and the X-Session-Env headers
+func requestEnv(r *http.Request) map[string]string {
+	variables := append(r.URL.Query()["env"], r.Header.Values(internal.SessionEnvHeader)...)
+	if len(variables) == 0 {
+		return nil
+	}
+	env := make(map[string]string, len(variables))
+	for _, variable := range variables {
+		name, value := splitEnv(variable)
+		env[name] = value
+	}
+	return env
+}
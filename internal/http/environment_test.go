@@ -0,0 +1,153 @@
+package http
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Sets the variables of the server for the test
+func setenv(t *testing.T, env map[string]string) {
+	for name, value := range env {
+		previous, ok := os.LookupEnv(name)
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+		name := name
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	setenv(t, map[string]string{
+		"PATH":          "/usr/bin:/bin",
+		"LC_TIME":       "C",
+		"LD_PRELOAD":    "/tmp/evil.so",
+		"AWS_SECRET":    "hunter2",
+		"SERVER_SECRET": "hunter2",
+		"TZ":            "UTC",
+	})
+	acc := &account{Name: "alice", Home: "/home/alice", Shell: "/bin/bash"}
+
+	tests := []struct {
+		name    string
+		config  EnvConfig
+		profile map[string]string
+		acc     *account
+		client  map[string]string
+		// The variables the command gets, an empty value meaning not set
+		want map[string]string
+	}{
+		{"defaults", EnvConfig{}, nil, nil, nil, map[string]string{
+			"PATH": "/usr/bin:/bin", "LC_TIME": "C", "TZ": "UTC", "TERM": defaultTerm,
+			"LD_PRELOAD": "", "AWS_SECRET": "", "SERVER_SECRET": "",
+		}},
+		{"inherited", EnvConfig{Inherit: []string{"PATH", "AWS_*", "LD_*"}}, nil, nil, nil, map[string]string{
+			"PATH": "/usr/bin:/bin", "AWS_SECRET": "hunter2", "LC_TIME": "", "TZ": "",
+			// Always scrubbed
+			"LD_PRELOAD": "",
+		}},
+		{"scrubbed from the server", EnvConfig{Inherit: []string{"PATH", "AWS_*"}, Scrub: []string{"AWS_*"}}, nil, nil, nil, map[string]string{
+			"PATH": "/usr/bin:/bin", "AWS_SECRET": "",
+		}},
+		{"accepted from the client", EnvConfig{}, nil, nil, map[string]string{
+			"TERM": "screen", "LANG": "fr_FR.UTF-8", "LC_ALL": "C", "TZ": "Europe/Paris",
+		}, map[string]string{
+			"TERM": "screen", "LANG": "fr_FR.UTF-8", "LC_ALL": "C", "TZ": "Europe/Paris",
+		}},
+		{"not accepted from the client", EnvConfig{}, nil, nil, map[string]string{
+			"PATH": "/tmp", "EDITOR": "vim", "LD_PRELOAD": "/tmp/evil.so", "BASH_ENV": "/tmp/x",
+		}, map[string]string{
+			"PATH": "/usr/bin:/bin", "EDITOR": "", "LD_PRELOAD": "", "BASH_ENV": "",
+		}},
+		{"scrubbed from the client", EnvConfig{Accept: []string{"LD_*", "BASH_FUNC_*", "EDITOR", "AWS_*"}, Scrub: []string{"AWS_*"}}, nil, nil, map[string]string{
+			"LD_PRELOAD": "/tmp/evil.so", "BASH_FUNC_ls%%": "() { rm -rf ~; }", "EDITOR": "vim", "AWS_SECRET": "x",
+		}, map[string]string{
+			"LD_PRELOAD": "", "BASH_FUNC_ls%%": "", "EDITOR": "vim", "AWS_SECRET": "",
+		}},
+		{"invalid from the client", EnvConfig{Accept: []string{"EDITOR*"}}, nil, nil, map[string]string{
+			"EDITOR=x": "y", "EDITOR": "vi\x00m", "EDITOR2": "nano",
+		}, map[string]string{
+			"EDITOR=x": "", "EDITOR": "", "EDITOR2": "nano",
+		}},
+		{"account", EnvConfig{}, nil, acc, map[string]string{"HOME": "/tmp"}, map[string]string{
+			"HOME": "/home/alice", "USER": "alice", "LOGNAME": "alice", "SHELL": "/bin/bash",
+		}},
+		{"profile over the others", EnvConfig{Accept: []string{"TERM", "EDITOR"}}, map[string]string{
+			"PATH": "/opt/bin", "TERM": "dumb", "EDITOR": "ed", "HOME": "/srv", "PAGER": "cat",
+		}, acc, map[string]string{
+			"TERM": "screen", "EDITOR": "vim",
+		}, map[string]string{
+			"PATH": "/opt/bin", "TERM": "dumb", "EDITOR": "ed", "HOME": "/srv", "PAGER": "cat", "USER": "alice",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := test.config.environment(&CommandProfile{Env: test.profile}, test.acc, test.client)
+			for name, want := range test.want {
+				value, ok := env[name]
+				if want == "" && ok {
+					t.Errorf("%s = %q, want it not set", name, value)
+				} else if want != "" && value != want {
+					t.Errorf("%s = %q, want %q", name, value, want)
+				}
+			}
+		})
+	}
+}
+
+// The profiles can't set the variables the configuration scrubs
+func TestEnvironmentScrubbedProfile(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Env.Scrub = []string{"AWS_*"}
+	cfg.Profiles["shell"].Env = map[string]string{"AWS_SECRET": "x"}
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "AWS_SECRET is scrubbed") {
+		t.Errorf("error = %v, want the variable scrubbed", err)
+	}
+	cfg.Profiles["shell"].Env = map[string]string{"LD_PRELOAD": "x"}
+	if err := cfg.validate(); err == nil {
+		t.Error("profile setting LD_PRELOAD accepted")
+	}
+	cfg.Profiles["shell"].Env = map[string]string{"EDITOR": "vim"}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestEnvConfigValidate(t *testing.T) {
+	for _, pattern := range []string{"PATH", "LC_*", "_X1"} {
+		if err := (&EnvConfig{Inherit: []string{pattern}}).validate(); err != nil {
+			t.Errorf("%s: unexpected error: %s", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"", "*", "1X", "A-B", "A*B", "A=B"} {
+		if err := (&EnvConfig{Accept: []string{pattern}}).validate(); err == nil {
+			t.Errorf("%q accepted", pattern)
+		}
+	}
+}
+
+func TestRequestEnv(t *testing.T) {
+	r := httptest.NewRequest("GET", "/s/new/ws?env=LANG%3Dfr_FR.UTF-8&env=TZ%3DUTC%3D1&env=EMPTY", nil)
+	r.Header.Add("X-Session-Env", "TERM=screen")
+	env := requestEnv(r)
+	want := map[string]string{"LANG": "fr_FR.UTF-8", "TZ": "UTC=1", "EMPTY": "", "TERM": "screen"}
+	if len(env) != len(want) {
+		t.Fatalf("env = %v, want %v", env, want)
+	}
+	for name, value := range want {
+		if env[name] != value {
+			t.Errorf("%s = %q, want %q", name, env[name], value)
+		}
+	}
+	if env := requestEnv(httptest.NewRequest("GET", "/", nil)); env != nil {
+		t.Errorf("env = %v, want none", env)
+	}
+}
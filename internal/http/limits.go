@@ -0,0 +1,147 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gg-tools/remotecommand/internal/audit"
+	"log"
+	"sync"
+	"time"
+)
+
+var errNoExtension = errors.New("the session cannot be extended")
+
+// How often the time limits of the sessions are checked
+const limitsCheckInterval = time.Second
+
+// Enforces the idle timeout and the max lifetime of a session, warning its participants before
+// terminating it
+type sessionLimits struct {
+	limits ProfileLimits
+
+	lock           sync.Mutex
+	deadline       time.Time // zero if there is no max lifetime
+	extensions     int
+	warnedIdle     bool
+	warnedDeadline time.Time
+}
+
+func newSessionLimits(limits ProfileLimits, startedAt time.Time) *sessionLimits {
+	if limits.WarnBefore == 0 {
+		limits.WarnBefore = defaultWarnBefore
+	}
+	l := &sessionLimits{limits: limits}
+	if limits.MaxLifetime > 0 {
+		l.deadline = startedAt.Add(time.Duration(limits.MaxLifetime))
+	}
+	return l
+}
+
+// Pushes the deadline of the session by the ExtendBy of its profile
+func (l *sessionLimits) extend() (time.Time, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.deadline.IsZero() {
+		return l.deadline, fmt.Errorf("%w: it has no max lifetime", errNoExtension)
+	}
+	if l.extensions >= l.limits.MaxExtensions {
+		return l.deadline, fmt.Errorf("%w: it was already extended %d time(s)", errNoExtension, l.extensions)
+	}
+	l.extensions++
+	l.deadline = l.deadline.Add(time.Duration(l.limits.ExtendBy))
+	return l.deadline, nil
+}
+
+func (l *sessionLimits) expiresAt() time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.deadline
+}
+
+// Decides what to do with a session whose last activity was at lastActivity: returns a warning
+// to send to its participants, or the reason why it has to be terminated
+func (l *sessionLimits) check(now, lastActivity time.Time) (warning string, terminate string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	warnBefore := time.Duration(l.limits.WarnBefore)
+
+	if !l.deadline.IsZero() {
+		left := l.deadline.Sub(now)
+		if left <= 0 {
+			return "", "it reached its max lifetime"
+		}
+		if left <= warnBefore && !l.warnedDeadline.Equal(l.deadline) {
+			l.warnedDeadline = l.deadline
+			warning = fmt.Sprintf("This session reaches its max lifetime and will be terminated in %s.", roundDuration(left))
+			if l.extensions < l.limits.MaxExtensions {
+				warning += fmt.Sprintf(" Press %s to extend it by %s.", extendKeysHelp, time.Duration(l.limits.ExtendBy))
+			}
+		}
+	}
+
+	if idleTimeout := time.Duration(l.limits.IdleTimeout); idleTimeout > 0 {
+		idle := now.Sub(lastActivity)
+		if idle >= idleTimeout {
+			return "", fmt.Sprintf("it was idle for %s", roundDuration(idle))
+		}
+		// With the default warn_before, which can be longer than a short idle timeout
+		if warnBefore >= idleTimeout {
+			warnBefore = idleTimeout / 2
+		}
+		if idle < idleTimeout-warnBefore {
+			l.warnedIdle = false
+		} else if !l.warnedIdle && warning == "" {
+			l.warnedIdle = true
+			warning = fmt.Sprintf("This session is idle and will be terminated in %s, unless there is some activity.", roundDuration(idleTimeout-idle))
+		}
+	}
+	return warning, ""
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(time.Second)
+}
+
+// The keys a client presses to extend its session. See the client's command keys.
+const extendKeysHelp = "Ctrl-] e"
+
+// Watches the time limits of the session until its command exits
+func (s *WSShell) watchLimits(sess *session) {
+	if sess.limits.expiresAt().IsZero() && sess.limits.limits.IdleTimeout == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(limitsCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sess.pty.Done():
+			return
+		case now := <-ticker.C:
+			warning, terminate := sess.limits.check(now, sess.session.LastActivity())
+			if warning != "" {
+				sess.session.Notice(warning)
+			}
+			if terminate != "" {
+				log.Printf("Terminating session %s: %s", sess.id, terminate)
+				s.audit.Emit(audit.Event{Type: audit.SessionTerminated, Session: sess.id, Reason: terminate})
+				sess.session.Notice("This session is terminated: " + terminate + ".")
+				sess.pty.Stop()
+				return
+			}
+		}
+	}
+}
+
+// Extends the lifetime of the session, if its profile allows it
+func (s *WSShell) extendSession(sess *session) (time.Time, error) {
+	deadline, err := sess.limits.extend()
+	if err != nil {
+		return deadline, err
+	}
+	log.Printf("Session %s extended until %s", sess.id, deadline.Format(time.RFC3339))
+	sess.session.Notice(fmt.Sprintf("This session was extended, it will be terminated at %s.", deadline.Format(time.RFC1123)))
+	return deadline, nil
+}
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionLimitsCheck(t *testing.T) {
+	type check struct {
+		// Since the start of the session
+		at, lastActivity time.Duration
+		// Parts of the warning and of the reason of the termination, empty if none
+		warning, terminate string
+	}
+	tests := []struct {
+		name   string
+		limits ProfileLimits
+		checks []check
+	}{
+		{"no limit", ProfileLimits{}, []check{
+			{time.Hour, 0, "", ""},
+		}},
+		{"max lifetime", ProfileLimits{MaxLifetime: Duration(time.Hour), WarnBefore: Duration(5 * time.Minute)}, []check{
+			{54 * time.Minute, 54 * time.Minute, "", ""},
+			{55 * time.Minute, 55 * time.Minute, "terminated in 5m0s", ""},
+			// Warned once
+			{56 * time.Minute, 56 * time.Minute, "", ""},
+			{time.Hour, time.Hour, "", "max lifetime"},
+		}},
+		{"max lifetime with extensions", ProfileLimits{MaxLifetime: Duration(time.Hour), WarnBefore: Duration(time.Minute), MaxExtensions: 1, ExtendBy: Duration(time.Hour)}, []check{
+			{59 * time.Minute, 59 * time.Minute, "Press " + extendKeysHelp + " to extend it by 1h0m0s", ""},
+		}},
+		{"default warn_before", ProfileLimits{MaxLifetime: Duration(time.Hour)}, []check{
+			{time.Hour - time.Duration(defaultWarnBefore) - time.Second, 0, "", ""},
+			{time.Hour - time.Duration(defaultWarnBefore), 0, "terminated in", ""},
+		}},
+		{"idle timeout", ProfileLimits{IdleTimeout: Duration(10 * time.Minute), WarnBefore: Duration(time.Minute)}, []check{
+			{8 * time.Minute, 0, "", ""},
+			{9 * time.Minute, 0, "idle and will be terminated in 1m0s", ""},
+			{9*time.Minute + 30*time.Second, 0, "", ""},
+			// Warned again once idle again
+			{11 * time.Minute, 5 * time.Minute, "", ""},
+			{14 * time.Minute, 5 * time.Minute, "idle and will be terminated in 1m0s", ""},
+			{15 * time.Minute, 5 * time.Minute, "", "idle for 10m0s"},
+		}},
+		{"idle timeout shorter than the default warn_before", ProfileLimits{IdleTimeout: Duration(time.Minute)}, []check{
+			{29 * time.Second, 0, "", ""},
+			{30 * time.Second, 0, "terminated in 30s", ""},
+			{time.Minute, 0, "", "idle for 1m0s"},
+		}},
+		{"max lifetime first", ProfileLimits{MaxLifetime: Duration(time.Hour), IdleTimeout: Duration(10 * time.Minute), WarnBefore: Duration(time.Minute)}, []check{
+			{59 * time.Minute, 50 * time.Minute, "max lifetime", ""},
+			{59*time.Minute + 30*time.Second, 50 * time.Minute, "idle", ""},
+			{time.Hour, 50 * time.Minute, "", "max lifetime"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Unix(1700000000, 0)
+			limits := newSessionLimits(test.limits, start)
+			for i, check := range test.checks {
+				warning, terminate := limits.check(start.Add(check.at), start.Add(check.lastActivity))
+				if (warning == "") != (check.warning == "") || !strings.Contains(warning, check.warning) {
+					t.Errorf("check %d: warning = %q, want %q", i, warning, check.warning)
+				}
+				if (terminate == "") != (check.terminate == "") || !strings.Contains(terminate, check.terminate) {
+					t.Errorf("check %d: terminate = %q, want %q", i, terminate, check.terminate)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionLimitsExtend(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	limits := newSessionLimits(ProfileLimits{MaxLifetime: Duration(time.Hour), WarnBefore: Duration(time.Minute), MaxExtensions: 1, ExtendBy: Duration(30 * time.Minute)}, start)
+	if warning, _ := limits.check(start.Add(59*time.Minute), start); warning == "" {
+		t.Fatal("not warned")
+	}
+	deadline, err := limits.extend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add(90 * time.Minute); !deadline.Equal(want) || !limits.expiresAt().Equal(want) {
+		t.Errorf("deadline = %s, want %s", deadline, want)
+	}
+	if _, err := limits.extend(); !errors.Is(err, errNoExtension) {
+		t.Errorf("extended twice: error = %v", err)
+	}
+	// Warned again before the new deadline, without the offer to extend it
+	warning, terminate := limits.check(start.Add(89*time.Minute), start.Add(89*time.Minute))
+	if warning == "" || strings.Contains(warning, "Press") || terminate != "" {
+		t.Errorf("warning = %q, terminate = %q", warning, terminate)
+	}
+
+	if _, err := newSessionLimits(ProfileLimits{}, start).extend(); !errors.Is(err, errNoExtension) {
+		t.Errorf("extended without max lifetime: error = %v", err)
+	}
+}
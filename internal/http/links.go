@@ -0,0 +1,240 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gg-tools/remotecommand/internal/auth"
+	"github.com/gg-tools/remotecommand/internal/tty"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInvalidLink = errors.New("invalid share link")
+
+// Query parameter carrying the token of a share link
+const shareLinkParam = "share"
+
+// How long the share links are valid, when not told otherwise
+const defaultShareLinkTTL = time.Hour
+
+// Share links let someone join a session, with a given role, without credentials of their own.
+// The token of a link is made of a JSON payload and of its HMAC-SHA256, both base64url encoded and
+// separated by a dot. The links are also tracked by the server, so that they can be revoked, or
+// used only once. They are signed with a secret generated when the server starts: they don't
+// outlive the sessions they are for anyway.
+type shareLinks struct {
+	secret []byte
+
+	lock  sync.Mutex
+	links map[string]*shareLink
+}
+
+type shareLink struct {
+	ID      string    `json:"id"`
+	Session string    `json:"session"`
+	Role    tty.Role  `json:"role"`
+	Name    string    `json:"name,omitempty"`
+	Expires time.Time `json:"expires_at"`
+	// Whether the link is revoked once someone joined with it
+	OneUse    bool   `json:"one_use"`
+	Used      bool   `json:"used"`
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+type shareLinkPayload struct {
+	ID        string `json:"lid"`
+	Session   string `json:"sid"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func newShareLinks() (*shareLinks, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &shareLinks{
+		secret: secret,
+		links:  make(map[string]*shareLink),
+	}, nil
+}
+
+// Who joins a session with the link, as seen by the others. Never the name of an identity, so that
+// the links can't be mistaken for the owners of the sessions.
+func (link *shareLink) identity() string {
+	if link.Name != "" {
+		return "link:" + link.Name
+	}
+	return "link:" + link.ID
+}
+
+// Creates a link to the session and returns its token
+func (l *shareLinks) mint(link shareLink) (*shareLink, string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, "", err
+	}
+	link.ID = id
+	payload, err := json.Marshal(shareLinkPayload{
+		ID:        link.ID,
+		Session:   link.Session,
+		Role:      string(link.Role),
+		ExpiresAt: link.Expires.Unix(),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	token := encodedPayload + "." + base64.RawURLEncoding.EncodeToString(l.mac(encodedPayload))
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(time.Now())
+	l.links[link.ID] = &link
+	return &link, token, nil
+}
+
+func (l *shareLinks) mac(encodedPayload string) []byte {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(encodedPayload))
+	return mac.Sum(nil)
+}
+
+// Returns the link of the token if it's valid for the session, without using it
+func (l *shareLinks) verify(token, session string) (*shareLink, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errInvalidLink
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, l.mac(parts[0])) {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidLink)
+	}
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad payload", errInvalidLink)
+	}
+	var payload shareLinkPayload
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return nil, fmt.Errorf("%w: bad payload", errInvalidLink)
+	}
+	if payload.Session != session {
+		return nil, fmt.Errorf("%w: the link is for another session", errInvalidLink)
+	}
+	if time.Now().Unix() >= payload.ExpiresAt {
+		return nil, fmt.Errorf("%w: the link expired", errInvalidLink)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	link, ok := l.links[payload.ID]
+	if !ok {
+		return nil, fmt.Errorf("%w: the link was revoked", errInvalidLink)
+	}
+	if link.OneUse && link.Used {
+		return nil, fmt.Errorf("%w: the link was already used", errInvalidLink)
+	}
+	copied := *link
+	return &copied, nil
+}
+
+// Verifies the token, and marks its link as used
+func (l *shareLinks) use(token, session string) (*shareLink, error) {
+	link, err := l.verify(token, session)
+	if err != nil {
+		return nil, err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	stored, ok := l.links[link.ID]
+	if !ok || (stored.OneUse && stored.Used) {
+		// Revoked, or used by someone else, in the meantime
+		return nil, errInvalidLink
+	}
+	stored.Used = true
+	return link, nil
+}
+
+// Lets a one-use link be used again, when the join it was used for failed
+func (l *shareLinks) release(id string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if link, ok := l.links[id]; ok {
+		link.Used = false
+	}
+}
+
+// Returns false if there is no such link to the session
+func (l *shareLinks) revoke(session, id string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	link, ok := l.links[id]
+	if !ok || link.Session != session {
+		return false
+	}
+	delete(l.links, id)
+	return true
+}
+
+// Revokes all the links to the session, once it's over
+func (l *shareLinks) revokeSession(session string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for id, link := range l.links {
+		if link.Session == session {
+			delete(l.links, id)
+		}
+	}
+}
+
+// The links to the session which can still be used, the oldest first
+func (l *shareLinks) list(session string) []shareLink {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(time.Now())
+	links := []shareLink{}
+	for _, link := range l.links {
+		if link.Session == session && !(link.OneUse && link.Used) {
+			links = append(links, *link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Expires.Before(links[j].Expires)
+	})
+	return links
+}
+
+// Forgets the expired links
+func (l *shareLinks) prune(now time.Time) {
+	for id, link := range l.links {
+		if !now.Before(link.Expires) {
+			delete(l.links, id)
+		}
+	}
+}
+
+// Lets the requests carrying a valid share link through the authentication, for the session of
+// the link only
+func (l *shareLinks) Authenticate(r *http.Request) (*auth.Identity, error) {
+	token := r.URL.Query().Get(shareLinkParam)
+	if token == "" {
+		return nil, auth.ErrNoCredentials
+	}
+	session := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/s/"), "/ws")
+	if session == r.URL.Path || strings.Contains(session, "/") {
+		return nil, fmt.Errorf("%w: share links are only valid to join their session", auth.ErrInvalidCredentials)
+	}
+	link, err := l.verify(token, session)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", auth.ErrInvalidCredentials, err.Error())
+	}
+	return &auth.Identity{Name: link.identity(), Role: string(link.Role)}, nil
+}
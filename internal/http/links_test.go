@@ -0,0 +1,164 @@
+package http
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gg-tools/remotecommand/internal/tty"
+)
+
+func TestShareLinks(t *testing.T) {
+	links, err := newShareLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mint := func(link shareLink) string {
+		_, token, err := links.mint(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	later := time.Now().Add(time.Hour)
+	valid := mint(shareLink{Session: "s1", Role: tty.RoleViewer, Expires: later})
+	oneUse := mint(shareLink{Session: "s1", Role: tty.RoleDriver, Expires: later, OneUse: true})
+	expired := mint(shareLink{Session: "s1", Role: tty.RoleViewer, Expires: time.Now().Add(-time.Second)})
+	other, err := newShareLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, foreign, err := other.mint(shareLink{Session: "s1", Role: tty.RoleViewer, Expires: later})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature := splitToken(t, valid)
+	_, driverSignature := splitToken(t, oneUse)
+
+	tests := []struct {
+		name    string
+		token   string
+		session string
+		// Empty if the link is valid
+		err string
+	}{
+		{"valid", valid, "s1", ""},
+		{"wrong session", valid, "s2", "another session"},
+		{"expired", expired, "s1", "expired"},
+		{"signed by another server", foreign, "s1", "bad signature"},
+		{"signature of another link", payload + "." + driverSignature, "s1", "bad signature"},
+		{"truncated signature", payload + "." + signature[:10], "s1", "bad signature"},
+		{"no signature", payload, "s1", "invalid share link"},
+		{"empty", "", "s1", "invalid share link"},
+		{"garbage", "a.b.c", "s1", "invalid share link"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			link, err := links.verify(test.token, test.session)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if link.Session != "s1" || link.Role != tty.RoleViewer {
+					t.Errorf("unexpected link: %+v", link)
+				}
+				return
+			}
+			if !errors.Is(err, errInvalidLink) {
+				t.Fatalf("error = %v, want an invalid link", err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error = %q, want it to mention %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestShareLinkOneUse(t *testing.T) {
+	links, err := newShareLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, token, err := links.mint(shareLink{Session: "s1", Role: tty.RoleDriver, Expires: time.Now().Add(time.Hour), OneUse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := links.use(token, "s1"); err != nil {
+		t.Fatalf("first use: %s", err)
+	}
+	if _, err := links.use(token, "s1"); !errors.Is(err, errInvalidLink) {
+		t.Fatalf("second use: error = %v, want an invalid link", err)
+	}
+	if _, err := links.verify(token, "s1"); !errors.Is(err, errInvalidLink) {
+		t.Fatalf("verify once used: error = %v, want an invalid link", err)
+	}
+	if listed := links.list("s1"); len(listed) != 0 {
+		t.Errorf("used link still listed: %+v", listed)
+	}
+
+	// The join failed
+	links.release(link.ID)
+	if _, err := links.use(token, "s1"); err != nil {
+		t.Fatalf("use once released: %s", err)
+	}
+
+	if !links.revoke("s1", link.ID) {
+		t.Fatal("cannot revoke the link")
+	}
+	links.release(link.ID)
+	if _, err := links.verify(token, "s1"); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf("verify once revoked: error = %v, want a revoked link", err)
+	}
+}
+
+func TestShareLinkAuthenticate(t *testing.T) {
+	links, err := newShareLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := links.mint(shareLink{Session: "s1", Role: tty.RoleViewer, Name: "guest", Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"/s/s1/ws", true},
+		{"/s/s2/ws", false},
+		{"/s/new/ws", false},
+		{"/api/sessions", false},
+		{"/api/sessions/s1/links", false},
+		{"/s/s1/ws/extra", false},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.path+"?"+shareLinkParam+"="+token, nil)
+			identity, err := links.Authenticate(r)
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("authenticated as %+v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if identity.Name != "link:guest" || identity.Role != string(tty.RoleViewer) {
+				t.Errorf("unexpected identity: %+v", identity)
+			}
+		})
+	}
+}
+
+func splitToken(t *testing.T, token string) (string, string) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		t.Fatalf("malformed token %q", token)
+	}
+	return parts[0], parts[1]
+}
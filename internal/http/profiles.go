@@ -0,0 +1,266 @@
+package http
+
+import (
+	"fmt"
+	"github.com/gg-tools/remotecommand/internal"
+	"github.com/gg-tools/remotecommand/internal/redact"
+	"github.com/gg-tools/remotecommand/internal/tty"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const defaultProfile = "shell"
+
+// Describes a command which can be started in a session. Only the commands of the configured
+// profiles can be started by the clients.
+type CommandProfile struct {
+	Argv   []string          `json:"argv"`
+	Dir    string            `json:"dir"`
+	Env    map[string]string `json:"env"`
+	Limits ProfileLimits     `json:"limits"`
+	// How long the command has to exit after being asked to, before it's killed
+	StopGracePeriod Duration `json:"stop_grace_period"`
+	// Whether the connections joining a running session wait for one of its owners to let them in
+	JoinApproval bool `json:"join_approval"`
+
+	// The Unix account the command runs as, instead of the user of the server
+	User string `json:"user"`
+	// Run the command as the Unix account of the identity which starts the session. See
+	// Config.Users.
+	UserFromIdentity bool `json:"user_from_identity"`
+	// Start the command like login does: with a "-" prefixed argv[0], so that shells read their
+	// profile. Not supported when entering a target.
+	LoginShell bool `json:"login_shell"`
+	// Let the clients choose a process or a container whose namespaces and cgroup the command
+	// runs in, instead of the ones of the server
+	AllowTarget bool `json:"allow_target"`
+	// Isolates the command from the host, in its own namespaces
+	Sandbox *SandboxConfig `json:"sandbox"`
+	// Limits what all the processes of a session can use together, with a cgroup
+	Resources *ResourcesConfig `json:"resources"`
+	// Limits what each of the processes of a session can use
+	Rlimits *RlimitsConfig `json:"rlimits"`
+	// Checks the command lines typed in the sessions before they run, e.g. to block "rm -rf /".
+	// A line gets the action of the first rule it matches.
+	InputRules []InputRuleConfig `json:"input_rules"`
+	// Masks the secrets in the output the viewers get, and in the input lines persisted in the
+	// audit log and in the log. The drivers get the output as it is.
+	Redact *RedactConfig `json:"redact"`
+}
+
+type InputRuleConfig struct {
+	// Regular expression matched against the whole command line, e.g. "(?i)drop\\s+table"
+	Pattern string `json:"pattern"`
+	// "block", "warn" or "confirm"
+	Action string `json:"action"`
+	// Shown to the typist, e.g. why the command is dangerous
+	Message string `json:"message"`
+}
+
+type RedactConfig struct {
+	// The rules built in: "aws", "bearer" and "pem". All of them if not set.
+	Builtin *[]string `json:"builtin"`
+	// Regular expressions of more secrets. If a pattern has groups, only the first one is masked.
+	Patterns []string `json:"patterns"`
+}
+
+// The zero values mean no limit
+type ResourcesConfig struct {
+	// How many CPUs worth of time, e.g.: 1.5
+	CPUs float64 `json:"cpus"`
+	// E.g.: "512M", "2G"
+	Memory string `json:"memory"`
+	Pids   int    `json:"pids"`
+}
+
+// The limits which are not set are inherited from the server
+type RlimitsConfig struct {
+	OpenFiles *uint64 `json:"open_files"`
+	// In bytes. 0 disables the core dumps.
+	CoreSize *uint64 `json:"core_size"`
+	// Counts all the processes of the user the command runs as, not only the ones of the session
+	Processes *uint64 `json:"processes"`
+}
+
+type SandboxConfig struct {
+	// Directory mounted read-only as the root of the command. Defaults to "/".
+	Root string `json:"root"`
+	// Directory of the sandbox the command can write to, e.g. "/tmp". A new tmpfs is mounted
+	// there, unless scratch_dir is set. Nothing is writable if empty.
+	Scratch string `json:"scratch"`
+	// Directory of the host mounted at scratch, instead of a tmpfs
+	ScratchDir string `json:"scratch_dir"`
+	Hostname   string `json:"hostname"`
+	// Keep the command from reaching the network, with a loopback interface only
+	IsolateNetwork bool `json:"isolate_network"`
+}
+
+type ProfileLimits struct {
+	// Maximum number of sessions of this profile running at the same time. 0 means no limit.
+	MaxSessions int `json:"max_sessions"`
+	// The sessions without input or output for that long are terminated. 0 means no limit.
+	IdleTimeout Duration `json:"idle_timeout"`
+	// The sessions are terminated once they have been running for that long, unless they are
+	// extended. 0 means no limit.
+	MaxLifetime Duration `json:"max_lifetime"`
+	// How many times, and by how much, the participants can extend the lifetime of a session
+	MaxExtensions int      `json:"max_extensions"`
+	ExtendBy      Duration `json:"extend_by"`
+	// How long before being terminated the participants are warned. Defaults to 1 minute, or to
+	// half of the idle timeout if it's shorter.
+	WarnBefore Duration `json:"warn_before"`
+}
+
+const defaultWarnBefore = Duration(time.Minute)
+
+func defaultProfiles() map[string]*CommandProfile {
+	return map[string]*CommandProfile{
+		defaultProfile: {Argv: []string{"bash"}},
+	}
+}
+
+func (p *CommandProfile) validate(name string) error {
+	if len(p.Argv) == 0 || p.Argv[0] == "" {
+		return fmt.Errorf("profile %s: argv is empty", name)
+	}
+	if p.StopGracePeriod < 0 {
+		return fmt.Errorf("profile %s: invalid stop_grace_period", name)
+	}
+	if p.User != "" && p.UserFromIdentity {
+		return fmt.Errorf("profile %s: user and user_from_identity are exclusive", name)
+	}
+	if sandbox := p.Sandbox; sandbox != nil {
+		for _, dir := range []string{sandbox.Root, sandbox.Scratch, sandbox.ScratchDir} {
+			if dir != "" && !filepath.IsAbs(dir) {
+				return fmt.Errorf("profile %s: the directories of the sandbox must be absolute", name)
+			}
+		}
+		if sandbox.ScratchDir != "" && sandbox.Scratch == "" {
+			return fmt.Errorf("profile %s: scratch_dir requires scratch", name)
+		}
+	}
+	if p.AllowTarget && (p.Sandbox != nil || p.Resources != nil) {
+		return fmt.Errorf("profile %s: allow_target cannot be combined with sandbox or resources", name)
+	}
+	if _, err := p.inputRules(); err != nil {
+		return fmt.Errorf("profile %s: %s", name, err.Error())
+	}
+	if _, err := p.redactor(); err != nil {
+		return fmt.Errorf("profile %s: redact: %s", name, err.Error())
+	}
+	if resources := p.Resources; resources != nil {
+		if resources.CPUs < 0 || resources.Pids < 0 {
+			return fmt.Errorf("profile %s: invalid resources", name)
+		}
+		if _, err := parseBytes(resources.Memory); err != nil {
+			return fmt.Errorf("profile %s: invalid memory: %s", name, err.Error())
+		}
+	}
+	if p.Limits.MaxSessions < 0 {
+		return fmt.Errorf("profile %s: invalid max_sessions", name)
+	}
+	if p.Limits.IdleTimeout < 0 || p.Limits.MaxLifetime < 0 || p.Limits.WarnBefore < 0 {
+		return fmt.Errorf("profile %s: invalid time limits", name)
+	}
+	if p.Limits.IdleTimeout > 0 && p.Limits.WarnBefore >= p.Limits.IdleTimeout {
+		return fmt.Errorf("profile %s: warn_before must be shorter than idle_timeout", name)
+	}
+	if p.Limits.MaxExtensions < 0 || (p.Limits.MaxExtensions > 0 && p.Limits.ExtendBy <= 0) {
+		return fmt.Errorf("profile %s: max_extensions requires a positive extend_by", name)
+	}
+	return nil
+}
+
+func (r *ResourcesConfig) cgroupLimits() internal.CgroupLimits {
+	memory, _ := parseBytes(r.Memory)
+	return internal.CgroupLimits{
+		CPUs:   r.CPUs,
+		Memory: memory,
+		Pids:   r.Pids,
+	}
+}
+
+func (p *CommandProfile) inputRules() ([]tty.InputRule, error) {
+	rules := make([]tty.InputRule, 0, len(p.InputRules))
+	for i, config := range p.InputRules {
+		pattern, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("input rule #%d: %s", i+1, err.Error())
+		}
+		action, err := tty.ParseInputAction(config.Action)
+		if err != nil {
+			return nil, fmt.Errorf("input rule #%d: %s", i+1, err.Error())
+		}
+		rules = append(rules, tty.InputRule{Pattern: pattern, Action: action, Message: config.Message})
+	}
+	return rules, nil
+}
+
+// Returns nil if the profile doesn't redact the secrets
+func (p *CommandProfile) redactor() (*redact.Redactor, error) {
+	if p.Redact == nil {
+		return nil, nil
+	}
+	builtin := redact.BuiltinNames()
+	if p.Redact.Builtin != nil {
+		builtin = *p.Redact.Builtin
+	}
+	return redact.New(builtin, p.Redact.Patterns)
+}
+
+func (r *RlimitsConfig) rlimits() []internal.Rlimit {
+	var rlimits []internal.Rlimit
+	add := func(resource int, value *uint64) {
+		if value != nil {
+			rlimits = append(rlimits, internal.Rlimit{Resource: resource, Cur: *value, Max: *value})
+		}
+	}
+	add(syscall.RLIMIT_NOFILE, r.OpenFiles)
+	add(syscall.RLIMIT_CORE, r.CoreSize)
+	add(rlimitNproc, r.Processes)
+	return rlimits
+}
+
+// Not defined by the syscall package
+const rlimitNproc = 6
+
+// Parses a size in bytes, with an optional K, M, G or T suffix (powers of 1024). Empty means 0.
+func parseBytes(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	number := size
+	switch size[len(size)-1] {
+	case 'K', 'k':
+		multiplier = 1 << 10
+	case 'M', 'm':
+		multiplier = 1 << 20
+	case 'G', 'g':
+		multiplier = 1 << 30
+	case 'T', 't':
+		multiplier = 1 << 40
+	}
+	if multiplier != 1 {
+		number = size[:len(size)-1]
+	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 || value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return value * multiplier, nil
+}
+
+func profileNames(profiles map[string]*CommandProfile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
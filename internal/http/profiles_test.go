@@ -0,0 +1,108 @@
+package http
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/gg-tools/remotecommand/internal"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		size  string
+		bytes int64
+		// Whether the size is invalid
+		err bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"4096", 4096, false},
+		{"64K", 64 << 10, false},
+		{"512M", 512 << 20, false},
+		{"512m", 512 << 20, false},
+		{"1G", 1 << 30, false},
+		{"2T", 2 << 40, false},
+		{"8388607T", 8388607 << 40, false},
+		{"8388608T", 0, true},
+		{"9223372036854775807", 9223372036854775807, false},
+		{"9223372036854775808", 0, true},
+		{"-1M", 0, true},
+		{"1.5G", 0, true},
+		{"1GB", 0, true},
+		{"1 G", 0, true},
+		{"G", 0, true},
+		{"lots", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.size, func(t *testing.T) {
+			bytes, err := parseBytes(test.size)
+			if test.err {
+				if err == nil {
+					t.Fatalf("parsed as %d", bytes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if bytes != test.bytes {
+				t.Errorf("bytes = %d, want %d", bytes, test.bytes)
+			}
+		})
+	}
+}
+
+func TestProfileResources(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources ResourcesConfig
+		limits    internal.CgroupLimits
+		// Part of the validation error, empty if valid
+		err string
+	}{
+		{"all", ResourcesConfig{CPUs: 1.5, Memory: "512M", Pids: 100}, internal.CgroupLimits{CPUs: 1.5, Memory: 512 << 20, Pids: 100}, ""},
+		{"memory only", ResourcesConfig{Memory: "1G"}, internal.CgroupLimits{Memory: 1 << 30}, ""},
+		{"none", ResourcesConfig{}, internal.CgroupLimits{}, ""},
+		{"negative CPUs", ResourcesConfig{CPUs: -1}, internal.CgroupLimits{}, "invalid resources"},
+		{"negative pids", ResourcesConfig{Pids: -1}, internal.CgroupLimits{}, "invalid resources"},
+		{"invalid memory", ResourcesConfig{Memory: "lots"}, internal.CgroupLimits{}, "invalid memory"},
+		{"memory overflow", ResourcesConfig{Memory: "9999999999T"}, internal.CgroupLimits{}, "invalid memory"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resources := test.resources
+			profile := &CommandProfile{Argv: []string{"sh"}, Resources: &resources}
+			err := profile.validate("p")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want it to mention %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if limits := resources.cgroupLimits(); limits != test.limits {
+				t.Errorf("limits = %+v, want %+v", limits, test.limits)
+			}
+		})
+	}
+}
+
+func TestProfileRlimits(t *testing.T) {
+	openFiles, coreSize := uint64(4096), uint64(0)
+	rlimits := (&RlimitsConfig{OpenFiles: &openFiles, CoreSize: &coreSize}).rlimits()
+	want := []internal.Rlimit{
+		{Resource: syscall.RLIMIT_NOFILE, Cur: 4096, Max: 4096},
+		{Resource: syscall.RLIMIT_CORE, Cur: 0, Max: 0},
+	}
+	if len(rlimits) != len(want) {
+		t.Fatalf("rlimits = %+v, want %+v", rlimits, want)
+	}
+	for i := range want {
+		if rlimits[i] != want[i] {
+			t.Errorf("rlimits = %+v, want %+v", rlimits, want)
+		}
+	}
+}
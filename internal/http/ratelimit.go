@@ -0,0 +1,131 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errRateLimited = errors.New("too many requests")
+
+// Returned when a client goes over one of its rates
+type rateLimitedError struct {
+	what       string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("%s: too many %s, retry in %s", errRateLimited.Error(), e.what, e.retryAfter.Round(time.Second))
+}
+
+func (e *rateLimitedError) Is(target error) bool {
+	return target == errRateLimited
+}
+
+// How long the client has to wait before retrying, if the error is about a rate limit
+func retryAfter(err error) (time.Duration, bool) {
+	var limited *rateLimitedError
+	if errors.As(err, &limited) {
+		return limited.retryAfter, true
+	}
+	return 0, false
+}
+
+// Sets the Retry-After header of the response, if the error is about a rate limit
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if wait, ok := retryAfter(err); ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	}
+}
+
+// How often the clients which didn't come back for a while are forgotten
+const rateLimiterPruneInterval = time.Minute
+
+// Limits how often each client can do something, with a token bucket per client: the bucket holds
+// up to burst tokens, and gets rate tokens per second back
+type rateLimiter struct {
+	what  string
+	rate  float64
+	burst float64
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Returns nil if the limit is not configured
+func newRateLimiter(what string, limit RateLimit) *rateLimiter {
+	if limit.PerMinute <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(limit.PerMinute))
+	}
+	return &rateLimiter{
+		what:    what,
+		rate:    limit.PerMinute / 60,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Takes a token of the client, or returns a rateLimitedError if it has none left
+func (l *rateLimiter) allow(client string, now time.Time) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastPrune) > rateLimiterPruneInterval {
+		l.prune(now)
+	}
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+		return &rateLimitedError{what: l.what, retryAfter: wait}
+	}
+	bucket.tokens--
+	return nil
+}
+
+// Forgets the clients whose buckets are full again: they are as good as new
+func (l *rateLimiter) prune(now time.Time) {
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastPrune = now
+}
+
+// Who the rates are counted for: the identity of the request, or its IP address without
+// authentication or when configured so
+func (s *WSShell) rateLimitKey(r *http.Request) string {
+	if s.config.Limits.RateLimitBy != rateLimitByIP {
+		if identity := identityName(r); identity != "" {
+			return "identity " + identity
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip " + host
+}
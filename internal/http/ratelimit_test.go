@@ -0,0 +1,144 @@
+package http
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gg-tools/remotecommand/internal/auth"
+)
+
+func TestRateLimiter(t *testing.T) {
+	type attempt struct {
+		client string
+		// Since the first attempt
+		at time.Duration
+		// Zero if allowed
+		retryAfter time.Duration
+	}
+	tests := []struct {
+		name     string
+		limit    RateLimit
+		attempts []attempt
+	}{
+		{"burst", RateLimit{PerMinute: 6, Burst: 3}, []attempt{
+			{"a", 0, 0},
+			{"a", 0, 0},
+			{"a", 0, 0},
+			{"a", 0, 10 * time.Second},
+			{"a", 4 * time.Second, 6 * time.Second},
+		}},
+		{"burst defaults to the rate", RateLimit{PerMinute: 1.5}, []attempt{
+			{"a", 0, 0},
+			{"a", 0, 0},
+			{"a", 0, 40 * time.Second},
+		}},
+		{"refill", RateLimit{PerMinute: 6, Burst: 2}, []attempt{
+			{"a", 0, 0},
+			{"a", 0, 0},
+			{"a", 5 * time.Second, 5 * time.Second},
+			{"a", 10 * time.Second, 0},
+			{"a", 10 * time.Second, 10 * time.Second},
+			// Not more than the burst, after a long quiet period
+			{"a", time.Hour, 0},
+			{"a", time.Hour, 0},
+			{"a", time.Hour, 10 * time.Second},
+		}},
+		{"refused attempts are not counted", RateLimit{PerMinute: 6, Burst: 1}, []attempt{
+			{"a", 0, 0},
+			{"a", time.Second, 9 * time.Second},
+			{"a", 2 * time.Second, 8 * time.Second},
+			{"a", 10 * time.Second, 0},
+		}},
+		{"per client", RateLimit{PerMinute: 6, Burst: 1}, []attempt{
+			{"a", 0, 0},
+			{"a", 0, 10 * time.Second},
+			{"b", 0, 0},
+			{"b", 0, 10 * time.Second},
+			{"a", 10 * time.Second, 0},
+			{"b", 10 * time.Second, 0},
+		}},
+		{"pruned clients start over", RateLimit{PerMinute: 6, Burst: 1}, []attempt{
+			{"a", 0, 0},
+			{"b", 0, 0},
+			{"a", 2 * rateLimiterPruneInterval, 0},
+			{"b", 2 * rateLimiterPruneInterval, 0},
+			{"b", 2 * rateLimiterPruneInterval, 10 * time.Second},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiter("sessions", test.limit)
+			start := time.Unix(1700000000, 0)
+			for i, attempt := range test.attempts {
+				err := limiter.allow(attempt.client, start.Add(attempt.at))
+				if attempt.retryAfter == 0 {
+					if err != nil {
+						t.Fatalf("attempt %d: unexpected error: %s", i, err)
+					}
+					continue
+				}
+				if !errors.Is(err, errRateLimited) {
+					t.Fatalf("attempt %d: error = %v, want rate limited", i, err)
+				}
+				if wait, _ := retryAfter(err); wait.Round(time.Millisecond) != attempt.retryAfter {
+					t.Errorf("attempt %d: retry after %s, want %s", i, wait, attempt.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterNotConfigured(t *testing.T) {
+	limiter := newRateLimiter("sessions", RateLimit{Burst: 1})
+	if limiter != nil {
+		t.Fatal("limiter without rate")
+	}
+	for i := 0; i < 10; i++ {
+		if err := limiter.allow("a", time.Now()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		by       string
+		identity string
+		key      string
+	}{
+		{"", "alice", "identity alice"},
+		{"", "", "ip 192.0.2.1"},
+		{rateLimitByIdentity, "alice", "identity alice"},
+		{rateLimitByIdentity, "", "ip 192.0.2.1"},
+		{rateLimitByIP, "alice", "ip 192.0.2.1"},
+		{rateLimitByIP, "", "ip 192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.by+" "+test.identity, func(t *testing.T) {
+			s := &WSShell{config: &Config{Limits: ServerLimits{RateLimitBy: test.by}}}
+			r := httptest.NewRequest("GET", "/s/new/ws", nil)
+			r.RemoteAddr = "192.0.2.1:54321"
+			if test.identity != "" {
+				r = r.WithContext(auth.WithIdentity(r.Context(), &auth.Identity{Name: test.identity}))
+			}
+			if key := s.rateLimitKey(r); key != test.key {
+				t.Errorf("key = %q, want %q", key, test.key)
+			}
+		})
+	}
+}
+
+func TestSetRetryAfter(t *testing.T) {
+	w := httptest.NewRecorder()
+	setRetryAfter(w, &rateLimitedError{what: "sessions", retryAfter: 1500 * time.Millisecond})
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	w = httptest.NewRecorder()
+	setRetryAfter(w, errTooManySessions)
+	if got := w.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Retry-After = %q for another error", got)
+	}
+}
@@ -1,19 +1,148 @@
 package http
 
 import (
-	"fmt"
+	"context"
+	"github.com/gg-tools/remotecommand/internal/auth"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 )
 
-func Serve(bindAddr string) error {
-	wsShell := NewWSShell()
+const shuttingDownNotice = "The server is shutting down, your session will be closed."
+
+type Server struct {
+	shell      *WSShell
+	httpServer *http.Server
+}
+
+func NewServer(bindAddr string, config *Config) (*Server, error) {
+	emitter, err := config.auditEmitter()
+	if err != nil {
+		return nil, err
+	}
+	wsShell, err := NewWSShell(config, emitter)
+	if err != nil {
+		emitter.Close()
+		return nil, err
+	}
 	m := mux.NewRouter()
-	m.HandleFunc(fmt.Sprintf("/s/local/ws"), wsShell.Shell)
-	if err := http.ListenAndServe(bindAddr, m); err != nil {
+	m.HandleFunc("/s/new/ws", wsShell.Shell)
+	// kept for the clients using the former single session route
+	m.HandleFunc("/s/local/ws", wsShell.Shell)
+	m.HandleFunc("/s/{id}/ws", wsShell.Join)
+	NewSessionAPI(wsShell).Register(m)
+	NewAdminAPI(wsShell).Register(m)
+
+	var handler http.Handler = m
+	authenticator, err := config.authenticator()
+	if err != nil {
+		emitter.Close()
+		return nil, err
+	}
+	if authenticator != nil {
+		// The share links are tried first: they are only valid to join their session anyway
+		handler = auth.Middleware(auth.Chain{wsShell.links, authenticator}, m)
+	} else {
+		log.Println("WARNING: no authentication is configured, anyone reaching the server can start a session")
+	}
+
+	server := &Server{
+		shell: wsShell,
+		httpServer: &http.Server{
+			Addr:    bindAddr,
+			Handler: handler,
+		},
+	}
+	if config.TLS.enabled() {
+		if server.httpServer.TLSConfig, err = config.TLS.serverConfig(); err != nil {
+			emitter.Close()
+			return nil, err
+		}
+	}
+	return server, nil
+}
+
+// Serves until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	var err error
+	if s.httpServer.TLSConfig != nil {
+		// The certificate is served by the TLS configuration
+		err = s.httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = s.httpServer.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Println("serve http failed", err)
 		return err
 	}
 	return nil
 }
+
+// Stops accepting new sessions and lets the connected clients know that the server is going
+// away. The running sessions are given until the deadline of ctx to end, then they are stopped.
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Println("Shutting down ..")
+	s.shell.Drain(true)
+	s.shell.notifyAll(shuttingDownNotice)
+
+	s.waitSessions(ctx)
+
+	sessions := s.shell.sessions.list()
+	if len(sessions) > 0 {
+		log.Printf("Stopping %d session(s)", len(sessions))
+	}
+	var wg sync.WaitGroup
+	for _, sess := range sessions {
+		wg.Add(1)
+		go func(sess *session) {
+			defer wg.Done()
+			sess.pty.Stop()
+		}(sess)
+	}
+	wg.Wait()
+
+	// Give the sessions the time to let their clients know about the exit of their commands
+	endCtx, cancelEnd := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelEnd()
+	s.waitSessions(endCtx)
+
+	// The WS connections are hijacked, so they are not closed by the http server, but they are
+	// closed by the sessions once their commands are stopped
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.httpServer.Shutdown(shutdownCtx)
+	// The participants leaving are audited once their connections are closed
+	s.waitConnections(shutdownCtx)
+	if closeErr := s.shell.audit.Close(); closeErr != nil {
+		log.Printf("cannot close the audit log: %s", closeErr.Error())
+	}
+	return err
+}
+
+// Waits until there are no sessions left, or ctx is done
+func (s *Server) waitSessions(ctx context.Context) {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for len(s.shell.sessions.list()) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Waits until the WS connections are done with, or ctx is done
+func (s *Server) waitConnections(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.shell.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+	case <-done:
+	}
+}
@@ -0,0 +1,105 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Keeps track of the running sessions, so that they can be reached again by their ID.
+type sessionRegistry struct {
+	lock     sync.RWMutex
+	sessions map[string]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]*session),
+	}
+}
+
+func newSessionID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Generates a new ID for the session and registers it under that ID. If maxOfProfile is not 0,
+// the session is registered only if there are less sessions of its profile. Same for maxTotal,
+// with all the sessions.
+func (r *sessionRegistry) add(sess *session, maxOfProfile, maxTotal int) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if maxTotal > 0 && len(r.sessions) >= maxTotal {
+		return "", fmt.Errorf("%w: the server is limited to %d session(s)", errTooManySessions, maxTotal)
+	}
+	if maxOfProfile > 0 && r.countProfileLocked(sess.profile) >= maxOfProfile {
+		return "", fmt.Errorf("%w: profile %s is limited to %d session(s)", errTooManySessions, sess.profile, maxOfProfile)
+	}
+
+	for {
+		id, err := newSessionID()
+		if err != nil {
+			return "", err
+		}
+		if _, exists := r.sessions[id]; exists {
+			continue
+		}
+		sess.id = id
+		r.sessions[id] = sess
+		return id, nil
+	}
+}
+
+func (r *sessionRegistry) get(id string) (*session, bool) {
+	r.lock.RLock()
+	sess, ok := r.sessions[id]
+	r.lock.RUnlock()
+	return sess, ok
+}
+
+func (r *sessionRegistry) count() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.sessions)
+}
+
+func (r *sessionRegistry) countProfile(profile string) int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.countProfileLocked(profile)
+}
+
+func (r *sessionRegistry) countProfileLocked(profile string) (count int) {
+	for _, sess := range r.sessions {
+		if sess.profile == profile {
+			count++
+		}
+	}
+	return
+}
+
+func (r *sessionRegistry) remove(id string) {
+	r.lock.Lock()
+	delete(r.sessions, id)
+	r.lock.Unlock()
+}
+
+func (r *sessionRegistry) list() []*session {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		sessions = append(sessions, sess)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].pty.StartedAt().Before(sessions[j].pty.StartedAt())
+	})
+	return sessions
+}
@@ -0,0 +1,62 @@
+package http
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSessionRegistryCaps(t *testing.T) {
+	tests := []struct {
+		name                   string
+		maxOfProfile, maxTotal int
+		// The profiles of the sessions added in a row
+		profiles []string
+		// Part of the error of each addition, empty if added
+		errs []string
+	}{
+		{"no cap", 0, 0, []string{"a", "a", "b"}, []string{"", "", ""}},
+		{"profile cap", 2, 0, []string{"a", "a", "a", "b", "b", "b"}, []string{"", "", "profile a is limited to 2", "", "", "profile b is limited to 2"}},
+		{"global cap", 0, 2, []string{"a", "b", "c"}, []string{"", "", "server is limited to 2"}},
+		{"global cap first", 1, 1, []string{"a", "a", "b"}, []string{"", "server is limited to 1", "server is limited to 1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := newSessionRegistry()
+			for i, profile := range test.profiles {
+				id, err := registry.add(&session{profile: profile}, test.maxOfProfile, test.maxTotal)
+				if test.errs[i] == "" {
+					if err != nil {
+						t.Fatalf("session %d: unexpected error: %s", i, err)
+					}
+					if sess, ok := registry.get(id); !ok || sess.id != id {
+						t.Fatalf("session %d not registered as %s", i, id)
+					}
+					continue
+				}
+				if !errors.Is(err, errTooManySessions) || !strings.Contains(err.Error(), test.errs[i]) {
+					t.Fatalf("session %d: error = %v, want it to mention %q", i, err, test.errs[i])
+				}
+			}
+		})
+	}
+}
+
+// Once removed, the sessions leave room for new ones
+func TestSessionRegistryRemove(t *testing.T) {
+	registry := newSessionRegistry()
+	id, err := registry.add(&session{profile: "a"}, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.add(&session{profile: "a"}, 1, 0); !errors.Is(err, errTooManySessions) {
+		t.Fatalf("error = %v, want too many sessions", err)
+	}
+	registry.remove(id)
+	if registry.count() != 0 || registry.countProfile("a") != 0 {
+		t.Fatalf("session still counted")
+	}
+	if _, err := registry.add(&session{profile: "a"}, 1, 0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
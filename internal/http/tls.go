@@ -0,0 +1,211 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// When set, the clients have to present a certificate signed by one of these CAs
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+func (c *TLSConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+func (c *TLSConfig) validate() error {
+	if !c.enabled() {
+		if c.ClientCAFile != "" {
+			return errors.New("tls: client_ca_file requires cert_file and key_file")
+		}
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("tls: both cert_file and key_file are required")
+	}
+	return nil
+}
+
+// Builds the TLS configuration of the server. The certificate, and the CAs of the clients, are
+// reloaded when their files change, so that they can be renewed without restarting the server.
+func (c *TLSConfig) serverConfig() (*tls.Config, error) {
+	reloader := &certReloader{
+		certFile: c.CertFile,
+		keyFile:  c.KeyFile,
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if c.ClientCAFile != "" {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		caReloader := &clientCAReloader{
+			caFile: c.ClientCAFile,
+			base:   tlsConfig.Clone(),
+		}
+		if err := caReloader.reload(); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = caReloader.config.ClientCAs
+		tlsConfig.GetConfigForClient = caReloader.getConfigForClient
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// How often the files of the certificate, and of the CAs of the clients, are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// Serves the certificate of the server, reloading it when its files are modified
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock        sync.Mutex
+	cert        *tls.Certificate
+	modTime     time.Time
+	lastChecked time.Time
+}
+
+// The time the latest of the files was modified
+func filesModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) filesModTime() (time.Time, error) {
+	return filesModTime(r.certFile, r.keyFile)
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastChecked = time.Now()
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	check := time.Since(r.lastChecked) >= certCheckInterval
+	if check {
+		r.lastChecked = time.Now()
+	}
+	modTime := r.modTime
+	r.lock.Unlock()
+
+	if check {
+		// Keep serving the current certificate if the new one can't be loaded, e.g.: when
+		// only one of the files has been replaced so far
+		if latest, err := r.filesModTime(); err == nil && latest.After(modTime) {
+			if err := r.reload(); err != nil {
+				log.Printf("cannot reload the TLS certificate: %s", err.Error())
+			} else {
+				log.Println("Reloaded the TLS certificate")
+			}
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.cert, nil
+}
+
+// Serves the TLS configuration with the CAs of the clients, reloading them when their file is
+// modified
+type clientCAReloader struct {
+	caFile string
+	// The configuration of the server, without the CAs
+	base *tls.Config
+
+	lock        sync.Mutex
+	config      *tls.Config
+	modTime     time.Time
+	lastChecked time.Time
+}
+
+func (r *clientCAReloader) reload() error {
+	modTime, err := filesModTime(r.caFile)
+	if err != nil {
+		return err
+	}
+	pool, err := loadCertPool(r.caFile)
+	if err != nil {
+		return err
+	}
+	config := r.base.Clone()
+	config.ClientCAs = pool
+	r.lock.Lock()
+	r.config = config
+	r.modTime = modTime
+	r.lastChecked = time.Now()
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *clientCAReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.lock.Lock()
+	check := time.Since(r.lastChecked) >= certCheckInterval
+	if check {
+		r.lastChecked = time.Now()
+	}
+	modTime := r.modTime
+	r.lock.Unlock()
+
+	if check {
+		// Keep trusting the current CAs if the new ones can't be loaded
+		if latest, err := filesModTime(r.caFile); err == nil && latest.After(modTime) {
+			if err := r.reload(); err != nil {
+				log.Printf("cannot reload the CAs of the clients: %s", err.Error())
+			} else {
+				log.Println("Reloaded the CAs of the clients")
+			}
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.config, nil
+}
@@ -0,0 +1,167 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// Issues a certificate for the name, signed by the parent, or self-signed if nil
+func issue(t *testing.T, name string, parent *testCert, ca bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func writeFile(t *testing.T, path string, content []byte, modTime time.Time) {
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Whether the client with the certificate can complete a handshake with the server
+func handshake(serverConfig *tls.Config, serverCA *testCert, client *testCert) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tls.Server(serverConn, serverConfig).Handshake()
+	}()
+	tlsClient := tls.Client(clientConn, &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "server",
+		Certificates: []tls.Certificate{client.tlsCertificate()},
+		// The client can't tell it was refused before reading from the connection with TLS 1.3
+		MaxVersion: tls.VersionTLS12,
+	})
+	clientErr := tlsClient.Handshake()
+	serverErr := <-done
+	if serverErr != nil {
+		return serverErr
+	}
+	return clientErr
+}
+
+func TestClientCAReload(t *testing.T) {
+	oldCA, newCA := issue(t, "old CA", nil, true), issue(t, "new CA", nil, true)
+	server := issue(t, "server", oldCA, false)
+	oldClient, newClient := issue(t, "old client", oldCA, false), issue(t, "new client", newCA, false)
+
+	dir := t.TempDir()
+	config := TLSConfig{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	keyDER, err := x509.MarshalECPrivateKey(server.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+	writeFile(t, config.CertFile, server.certPEM(), start)
+	writeFile(t, config.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), start)
+	writeFile(t, config.ClientCAFile, oldCA.certPEM(), start)
+
+	tlsConfig, err := config.serverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(tlsConfig, oldCA, oldClient); err != nil {
+		t.Fatalf("client of the CA refused: %s", err)
+	}
+	if err := handshake(tlsConfig, oldCA, newClient); err == nil {
+		t.Fatal("client of another CA accepted")
+	}
+
+	if tlsConfig.GetConfigForClient == nil {
+		t.Fatal("the CAs are not reloaded")
+	}
+
+	// Reloaded the same way, on demand
+	reloader := &clientCAReloader{
+		caFile: config.ClientCAFile,
+		base: &tls.Config{
+			Certificates: []tls.Certificate{server.tlsCertificate()},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	}
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig = &tls.Config{GetConfigForClient: reloader.getConfigForClient}
+	writeFile(t, config.ClientCAFile, newCA.certPEM(), start.Add(time.Minute))
+	// Not checked again yet
+	if err := handshake(tlsConfig, oldCA, oldClient); err != nil {
+		t.Fatalf("client of the CA refused before the check: %s", err)
+	}
+	reloader.lastChecked = time.Time{}
+	if err := handshake(tlsConfig, oldCA, newClient); err != nil {
+		t.Fatalf("client of the new CA refused: %s", err)
+	}
+	if err := handshake(tlsConfig, oldCA, oldClient); err == nil {
+		t.Fatal("client of the old CA accepted")
+	}
+
+	// The current CAs are kept if the file can't be loaded
+	writeFile(t, config.ClientCAFile, []byte("garbage"), start.Add(2*time.Minute))
+	reloader.lastChecked = time.Time{}
+	if err := handshake(tlsConfig, oldCA, newClient); err != nil {
+		t.Fatalf("client of the new CA refused once the file is broken: %s", err)
+	}
+}
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var errNoAccount = errors.New("no account to run the session as")
+
+// The UIDs below are left to the system accounts on most distributions
+const defaultMinUID = 1000
+
+// A Unix account the commands of the sessions can run as
+type account struct {
+	Name   string
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+	Home   string
+	Shell  string
+}
+
+// Looks up a Unix account by its name, along with its supplementary groups and its login shell
+func lookupAccount(name string) (*account, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errNoAccount, err.Error())
+	}
+	acc := &account{Name: u.Username, Home: u.HomeDir}
+	if acc.Uid, err = parseID(u.Uid); err != nil {
+		return nil, err
+	}
+	if acc.Gid, err = parseID(u.Gid); err != nil {
+		return nil, err
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the groups of %s: %s", name, err.Error())
+	}
+	for _, groupID := range groupIDs {
+		gid, err := parseID(groupID)
+		if err != nil {
+			return nil, err
+		}
+		acc.Groups = append(acc.Groups, gid)
+	}
+	acc.Shell = loginShell(name)
+	return acc, nil
+}
+
+func parseID(id string) (uint32, error) {
+	parsed, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported user or group ID %s", id)
+	}
+	return uint32(parsed), nil
+}
+
+// The shell of the account in /etc/passwd, which os/user doesn't tell. Defaults to /bin/sh.
+func loginShell(name string) string {
+	const defaultShell = "/bin/sh"
+
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return defaultShell
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == name && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return defaultShell
+}
+
+func (acc *account) credential() *syscall.Credential {
+	return &syscall.Credential{
+		Uid:    acc.Uid,
+		Gid:    acc.Gid,
+		Groups: acc.Groups,
+	}
+}
+
+// The environment variables login sets for the account
+func (acc *account) env() []string {
+	return []string{
+		"HOME=" + acc.Home,
+		"USER=" + acc.Name,
+		"LOGNAME=" + acc.Name,
+		"SHELL=" + acc.Shell,
+	}
+}
@@ -1,116 +1,547 @@
 package http
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gg-tools/remotecommand/internal"
+	"github.com/gg-tools/remotecommand/internal/audit"
+	"github.com/gg-tools/remotecommand/internal/auth"
 	"github.com/gg-tools/remotecommand/internal/tty"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"io"
 	"log"
 	"net/http"
-	"os"
-	"strings"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errProfileNotAllowed = errors.New("profile not allowed")
+	errTooManySessions   = errors.New("too many sessions")
+	errDraining          = errors.New("the server is draining, no new sessions are accepted")
+	errInvalidTarget     = errors.New("invalid target")
+	errSessionFull       = errors.New("the session is full")
+	errNoOwner           = errors.New("no owner of the session is connected to let you in")
 )
 
 type WSShell struct {
+	config      *Config
+	sessions    *sessionRegistry
+	audit       *audit.Emitter
+	sessionRate *rateLimiter // nil without limit
+	connectRate *rateLimiter // nil without limit
+	links       *shareLinks
+	draining    uint32 // used with atomic
+	// The WS connections being served, which emit audit events until they are done
+	connections sync.WaitGroup
+}
+
+// The events of the sessions are sent to the emitter, which can be nil
+func NewWSShell(config *Config, emitter *audit.Emitter) (*WSShell, error) {
+	links, err := newShareLinks()
+	if err != nil {
+		return nil, err
+	}
+	return &WSShell{
+		config:      config,
+		sessions:    newSessionRegistry(),
+		audit:       emitter,
+		sessionRate: newRateLimiter("sessions", config.Limits.SessionRate),
+		connectRate: newRateLimiter("connections", config.Limits.ConnectRate),
+		links:       links,
+	}, nil
+}
+
+// In drain mode, no new sessions can be started, but the running ones can still be joined
+func (s *WSShell) Drain(drain bool) {
+	var flag uint32
+	if drain {
+		flag = 1
+	}
+	atomic.StoreUint32(&s.draining, flag)
 }
 
-func NewWSShell() *WSShell {
-	return &WSShell{}
+func (s *WSShell) Draining() bool {
+	return atomic.LoadUint32(&s.draining) != 0
 }
 
+// Sends a notice to the participants of all the sessions
+func (s *WSShell) notifyAll(text string) {
+	for _, sess := range s.sessions.list() {
+		sess.session.Notice(text)
+	}
+}
+
+// Starts a new session and attaches the connection to it. The command profile of the session can
+// be chosen through the "profile" query parameter, and the process or container it enters through
+// the "target" one. The client can send environment variables, see EnvConfig.Accept.
 func (s *WSShell) Shell(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
-
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+	if err := s.connectRate.allow(s.rateLimitKey(r), time.Now()); err != nil {
+		s.reject(w, r, err)
+		return
+	}
+	opts, status, err := joinOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if opts.Role != tty.RoleDriver {
+		http.Error(w, "viewers cannot start sessions", http.StatusForbidden)
+		return
+	}
+	opts.Owner = true
+	// Don't start a command for a request which can't be upgraded
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "a WS connection is expected", http.StatusBadRequest)
+		return
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
 
+	sess, err := s.newSession(sessionOptions{
+		Profile: r.URL.Query().Get("profile"),
+		Target:  r.URL.Query().Get("target"),
+		Owner:   opts.Identity,
+		Client:  s.rateLimitKey(r),
+		Env:     requestEnv(r),
+	})
 	if err != nil {
-		log.Println("cannot create the WS connection: ", err.Error())
+		s.reject(w, r, err)
 		return
 	}
 
-	// session
-	sess, err := createSession()
+	if err := s.serve(w, r, sess, opts); err != nil {
+		// Nobody is attached to the command, nor ever will be
+		log.Printf("Stopping session %s: %s", sess.id, err.Error())
+		sess.pty.Stop()
+	}
+}
+
+// Joins the connection to the running session identified by the {id} route variable, next to
+// the connections already attached to it. No new PTY is spawned. The connections with a share
+// link, in the "share" query parameter, join with the role of the link.
+func (s *WSShell) Join(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := s.connectRate.allow(s.rateLimitKey(r), time.Now()); err != nil {
+		s.reject(w, r, err)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	sess, ok := s.sessions.get(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	opts, status, err := joinOptions(r)
 	if err != nil {
-		log.Println("cannot create session: ", err.Error())
+		http.Error(w, err.Error(), status)
+		return
+	}
+	token := r.URL.Query().Get(shareLinkParam)
+	if token != "" {
+		link, err := s.links.verify(token, sess.id)
+		if err != nil {
+			s.reject(w, r, err)
+			return
+		}
+		// Without authentication, the role of the link isn't carried by the identity
+		opts.Identity = link.identity()
+		if link.Role == tty.RoleViewer {
+			opts.Role = tty.RoleViewer
+		}
+	}
+	opts.Owner = opts.Identity != "" && opts.Identity == sess.owner
+	if !opts.Owner && opts.Identity == "" && atomic.CompareAndSwapUint32(&sess.ownerToClaim, 1, 0) {
+		opts.Owner = true
+	}
+	opts.RequireApproval = sess.joinApproval
+	// Checked again once the connection is upgraded, when it's too late for a status code
+	if !opts.Owner && sess.session.Full() {
+		s.reject(w, r, fmt.Errorf("%w: session %s", errSessionFull, sess.id))
+		return
+	}
+	if opts.RequireApproval && !opts.Owner && !sess.session.OwnerConnected() {
+		s.reject(w, r, fmt.Errorf("%w: session %s", errNoOwner, sess.id))
 		return
 	}
-	sess.setup()
+	if token != "" {
+		// Used last, so that it's not used up by a join which can't happen
+		link, err := s.links.use(token, sess.id)
+		if err != nil {
+			s.reject(w, r, err)
+			return
+		}
+		log.Printf("Share link %s of session %s used by %s", link.ID, sess.id, r.RemoteAddr)
+		if err := s.serve(w, r, sess, opts); err != nil {
+			s.links.release(link.ID)
+		}
+		return
+	}
+
+	s.serve(w, r, sess, opts)
+}
+
+// Turns the request away, before the WS upgrade
+func (s *WSShell) reject(w http.ResponseWriter, r *http.Request, err error) {
+	s.rejected(r, err)
+	setRetryAfter(w, err)
+	http.Error(w, err.Error(), sessionErrorStatus(err))
+}
+
+// Logs why the request was turned away
+func (s *WSShell) rejected(r *http.Request, err error) {
+	log.Printf("Rejected %s %s (%s, %s): %s", r.Method, r.URL.Path, s.rateLimitKey(r), r.RemoteAddr, err.Error())
+	s.audit.Emit(audit.Event{
+		Type:       audit.RequestRejected,
+		Identity:   identityName(r),
+		RemoteAddr: r.RemoteAddr,
+		Reason:     err.Error(),
+	})
+}
+
+// Returns an error if the connection could not be upgraded, once the response is sent, or if it
+// could not join the session
+func (s *WSShell) serve(w http.ResponseWriter, r *http.Request, sess *session, opts tty.JoinOptions) error {
+	// Counted before the upgrade, while the http server still waits for the request on shutdown
+	s.connections.Add(1)
+	defer s.connections.Done()
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+	header := http.Header{}
+	header.Set(internal.SessionIDHeader, sess.id)
+	conn, err := upgrader.Upgrade(w, r, header)
+
+	if err != nil {
+		log.Println("cannot create the WS connection: ", err.Error())
+		return err
+	}
 
 	// On a new connection, ask for a refresh/redraw of the terminal app
 	sess.pty.Refresh()
-	sess.session.HandleWSConnection(conn)
+	if err := sess.session.HandleWSConnection(conn, opts); err != nil {
+		log.Printf("cannot join session %s: %s", sess.id, err.Error())
+		return err
+	}
+	return nil
 }
 
 type session struct {
+	id      string
+	profile string
+	owner   string
+	// The environment the command was started with
+	env     map[string]string
 	pty     *internal.PtyMaster
 	session *tty.TTYShareSession
+	limits  *sessionLimits
+	// Whether the owners have to let in the connections joining the session
+	joinApproval bool
+	// 1 until the first connection joins a session created by the API without authentication,
+	// which has no owner otherwise. Used with atomic.
+	ownerToClaim uint32
+	// The Unix account the command runs as, empty if it runs as the user of the server
+	user string
+	// The process or container the session entered, if any
+	target string
 }
 
 func (s *session) Write(buff []byte) (written int, err error) {
 	return s.session.Write(buff)
 }
 
-func (s *session) setup() {
-	stopPtyAndRestore := func() {
-		s.pty.Stop()
-		s.pty.Restore()
-	}
-	// defer stopPtyAndRestore()
-
+// Wires the PTY to the share session. onEnd is called once the command's output is closed.
+func (s *session) setup(onEnd func()) {
 	if cols, rows, e := s.pty.GetWinSize(); e == nil {
 		s.session.WindowSize(cols, rows)
 	}
 
-	s.pty.SetWinChangeCB(func(cols, rows int) {
-		log.Printf("new window size: %dx%d", cols, rows)
-		s.session.WindowSize(cols, rows)
-	})
-
 	go func() {
-		_, err := io.Copy(s, s.pty)
-		if err != nil {
-			stopPtyAndRestore()
-		}
+		io.Copy(s, s.pty)
+		// Makes sure nothing is left running, once the output is closed
+		s.pty.Stop()
+		onEnd()
+		log.Printf("Session %s ended", s.id)
 	}()
 
+	// Once the command exits, collect what it left running in the background. This also
+	// closes the output, if those processes were keeping it open.
 	go func() {
-		_, err := io.Copy(s.pty, os.Stdin)
+		<-s.pty.Done()
+		s.pty.Stop()
+	}()
+}
+
+// The name of the identity the request was authenticated as, empty if authentication is disabled
+func identityName(r *http.Request) string {
+	if identity := auth.IdentityFrom(r.Context()); identity != nil {
+		return identity.Name
+	}
+	return ""
+}
+
+// The role granted to the request by its identity. Without authentication, everyone can drive.
+func requestRole(r *http.Request) tty.Role {
+	if identity := auth.IdentityFrom(r.Context()); identity != nil && identity.Role != "" {
+		if role, err := tty.ParseRole(identity.Role); err == nil {
+			return role
+		}
+		// Don't grant more than intended to an identity with a role we don't know about
+		return tty.RoleViewer
+	}
+	return tty.RoleDriver
+}
+
+// Who joins a session with this request. The clients can ask for the viewer role through the
+// "role" query parameter, but not for more than what their identity grants.
+func joinOptions(r *http.Request) (tty.JoinOptions, int, error) {
+	opts := tty.JoinOptions{
+		Identity: identityName(r),
+		Role:     requestRole(r),
+	}
+	if requested := r.URL.Query().Get("role"); requested != "" {
+		role, err := tty.ParseRole(requested)
 		if err != nil {
-			stopPtyAndRestore()
+			return opts, http.StatusBadRequest, err
 		}
-	}()
+		if role == tty.RoleDriver && opts.Role != tty.RoleDriver {
+			return opts, http.StatusForbidden, errors.New("the driver role is not granted")
+		}
+		opts.Role = role
+	}
+	return opts, http.StatusOK, nil
+}
 
+type sessionOptions struct {
+	Profile string
+	// The PID or the container whose namespaces the command enters, if any
+	Target string
+	// Who created the session
+	Owner string
+	// Whether its first connection joins as its owner, when it has no identity either, e.g. when it
+	// is created by the API without authentication
+	ClaimOwner bool
+	// Who the session rate is counted for, see rateLimitKey
+	Client string
+	Cols   int
+	Rows   int
+	// The environment variables sent by the client, which are only set if accepted
+	Env map[string]string
 }
 
-func createSession() (*session, error) {
-	commandName := "bash"
-	commandArgs := ""
+// Creates a new session, registers it and wires its PTY to the share session
+func (s *WSShell) newSession(opts sessionOptions) (*session, error) {
+	if s.Draining() {
+		return nil, errDraining
+	}
+	name, profile, err := s.config.profile(opts.Profile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errProfileNotAllowed, err.Error())
+	}
+	opts.Profile = name
+	if opts.Target != "" && !profile.AllowTarget {
+		return nil, fmt.Errorf("%w: profile %s does not allow targets", errProfileNotAllowed, name)
+	}
+	if max := profile.Limits.MaxSessions; max > 0 && s.sessions.countProfile(name) >= max {
+		return nil, fmt.Errorf("%w: profile %s is limited to %d session(s)", errTooManySessions, name, max)
+	}
+	if max := s.config.Limits.MaxSessions; max > 0 && s.sessions.count() >= max {
+		return nil, fmt.Errorf("%w: the server is limited to %d session(s)", errTooManySessions, max)
+	}
+	// Only the attempts which would start a command count
+	if err := s.sessionRate.allow(opts.Client, time.Now()); err != nil {
+		return nil, err
+	}
 
-	ptyMaster := internal.PtyMasterNew()
-	envVars := os.Environ()
-	err := ptyMaster.Start(commandName, strings.Fields(commandArgs), envVars)
+	acc, err := s.config.account(profile, opts.Owner)
 	if err != nil {
-		log.Printf("cannot start the %s command: %s", commandName, err.Error())
 		return nil, err
 	}
-	ptyMaster.MakeRaw()
+	sess, err := s.createSession(opts, profile, acc)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.sessions.add(sess, profile.Limits.MaxSessions, s.config.Limits.MaxSessions)
+	if err != nil {
+		sess.pty.Stop()
+		return nil, err
+	}
+	sess.session.SetAudit(s.audit, id)
+	s.audit.Emit(audit.Event{
+		Type:     audit.SessionCreated,
+		Session:  id,
+		Identity: sess.owner,
+		Profile:  sess.profile,
+		User:     sess.user,
+		Target:   sess.target,
+		Pid:      sess.pty.Pid(),
+		Cols:     opts.Cols,
+		Rows:     opts.Rows,
+	})
+	sess.setup(func() {
+		code, signal := sess.pty.ExitStatus()
+		log.Printf("Session %s: command exited with code %d %s", id, code, signal)
+		s.audit.Emit(audit.Event{
+			Type:            audit.SessionEnded,
+			Session:         id,
+			Profile:         sess.profile,
+			ExitCode:        &code,
+			Signal:          signal,
+			DurationSeconds: time.Since(sess.pty.StartedAt()).Seconds(),
+		})
+		sess.session.Exit(code, signal)
+		sess.session.Close()
+		s.sessions.remove(id)
+		s.links.revokeSession(id)
+	})
+	sess.session.SetOnExtend(func() {
+		if _, err := s.extendSession(sess); err != nil {
+			sess.session.Notice(err.Error())
+		}
+	})
+	go s.watchLimits(sess)
+	log.Printf("New session %s (%s)", id, sess.profile)
+	return sess, nil
+}
+
+// Maps the errors of newSession to HTTP status codes
+func sessionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errProfileNotAllowed), errors.Is(err, errNoAccount), errors.Is(err, errInvalidLink):
+		return http.StatusForbidden
+	case errors.Is(err, errInvalidTarget):
+		return http.StatusBadRequest
+	case errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errNoOwner):
+		return http.StatusConflict
+	case errors.Is(err, errTooManySessions), errors.Is(err, errSessionFull), errors.Is(err, errDraining):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
 
-	// stopPtyAndRestore := func() {
-	//	ptyMaster.Stop()
-	//	ptyMaster.Restore()
-	// }
-	// defer stopPtyAndRestore()
+// Starts the command of the profile, as the account if it's not nil
+func (s *WSShell) createSession(opts sessionOptions, profile *CommandProfile, acc *account) (*session, error) {
+	ptyMaster := internal.PtyMasterNew()
+	ptyMaster.SetWinSize(opts.Rows, opts.Cols)
+	if profile.StopGracePeriod > 0 {
+		ptyMaster.SetStopGracePeriod(time.Duration(profile.StopGracePeriod))
+	}
+	command := internal.Command{
+		Argv: profile.Argv,
+		Dir:  profile.Dir,
+	}
+	env := s.config.Env.environment(profile, acc, opts.Env)
+	if acc != nil {
+		command.Credential = acc.credential()
+		if command.Dir == "" {
+			command.Dir = acc.Home
+		}
+	}
+	if sandbox := profile.Sandbox; sandbox != nil {
+		command.Sandbox = &internal.Sandbox{
+			Root:           sandbox.Root,
+			Scratch:        sandbox.Scratch,
+			ScratchDir:     sandbox.ScratchDir,
+			Hostname:       sandbox.Hostname,
+			IsolateNetwork: sandbox.IsolateNetwork,
+		}
+	}
+	if opts.Target != "" {
+		if err := enterTarget(&command, opts.Target, profile.Dir); err != nil {
+			return nil, err
+		}
+	}
+	if profile.Rlimits != nil {
+		command.Rlimits = profile.Rlimits.rlimits()
+	}
+	if profile.LoginShell {
+		command.Arg0 = "-" + filepath.Base(profile.Argv[0])
+	}
+	command.Env = envList(env)
+
+	if profile.Resources != nil {
+		// Named before the session gets its ID, which happens once it's started
+		name, err := newSessionID()
+		if err != nil {
+			return nil, err
+		}
+		command.Cgroup, err = internal.NewCgroup(s.config.CgroupParent, "session-"+name, profile.Resources.cgroupLimits())
+		if err != nil {
+			log.Printf("cannot create the cgroup of the session: %s", err.Error())
+			return nil, err
+		}
+	}
+	err := ptyMaster.Start(command)
+	if err != nil {
+		log.Printf("cannot start the %s command: %s", profile.Argv[0], err.Error())
+		if command.Cgroup != nil {
+			command.Cgroup.Remove()
+		}
+		return nil, err
+	}
 
 	pty := ptyMaster
-	return &session{
-		pty:     pty,
-		session: tty.NewTTYShareSession(pty),
-	}, nil
+	sess := &session{
+		profile:      opts.Profile,
+		owner:        opts.Owner,
+		env:          env,
+		pty:          pty,
+		session:      tty.NewTTYShareSession(pty),
+		limits:       newSessionLimits(profile.Limits, pty.StartedAt()),
+		joinApproval: profile.JoinApproval,
+	}
+	if opts.ClaimOwner && opts.Owner == "" {
+		sess.ownerToClaim = 1
+	}
+	if acc != nil {
+		sess.user = acc.Name
+	}
+	// Validated with the configuration
+	inputRules, _ := profile.inputRules()
+	sess.session.SetInputRules(inputRules)
+	redactor, _ := profile.redactor()
+	sess.session.SetRedactor(redactor)
+	sess.session.SetMaxParticipants(s.config.Limits.MaxParticipants)
+	sess.target = opts.Target
+	return sess, nil
+}
+
+// Makes the command run in the namespaces and the cgroup of the target. The command starts in dir
+// in the target, or in the working directory of the target if empty: the home of the account on
+// the host doesn't mean anything there.
+func enterTarget(command *internal.Command, target, dir string) error {
+	pid, err := internal.ResolveTarget(target)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidTarget, err.Error())
+	}
+	cgroup, err := internal.CgroupOf(pid)
+	if err != nil {
+		return err
+	}
+	argv, credential, err := internal.EnterCommand(pid, command.Argv, dir, command.Credential)
+	if err != nil {
+		return err
+	}
+	log.Printf("Entering the namespaces of %s (PID %d)", target, pid)
+	command.Argv = argv
+	command.Arg0 = ""
+	command.Dir = ""
+	// nsenter needs to be root, and switches to the uid of the account itself
+	command.Credential = credential
+	command.JoinCgroup = cgroup
+	return nil
 }
@@ -1,78 +1,227 @@
 package internal
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
-	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unsafe"
 
 	ptyDevice "github.com/creack/pty"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
-type onWindowChangedCB func(int, int)
+// The window size a command gets when it's started, before any client resizes it
+const (
+	defaultCols = 80
+	defaultRows = 24
+)
+
+// How long Stop waits for the command to exit after asking it to, before killing it
+const DefaultStopGracePeriod = 3 * time.Second
 
 // This defines a PTY Master whih will encapsulate the command we want to run, and provide simple
 // access to the command, to write and read IO, but also to control the window size.
+// The PTY is not tied to the stdio of the process running it, so it can be used from a daemon
+// without a controlling terminal.
 type PtyMaster struct {
-	ptyFile           *os.File
-	command           *exec.Cmd
-	terminalInitState *terminal.State
+	ptyFile   *os.File
+	command   *exec.Cmd
+	startedAt time.Time
+	cgroup    *Cgroup
+
+	stopGracePeriod time.Duration
+	stopOnce        sync.Once
+	// Closed once the command has been waited for. waitErr is set before that.
+	done    chan struct{}
+	waitErr error
+
+	// The size of the window is owned by the PTY: it's set by the clients of the session
+	sizeLock sync.Mutex
+	cols     int
+	rows     int
 }
 
 func PtyMasterNew() *PtyMaster {
-	return &PtyMaster{}
+	return &PtyMaster{
+		cols:            defaultCols,
+		rows:            defaultRows,
+		stopGracePeriod: DefaultStopGracePeriod,
+		done:            make(chan struct{}),
+	}
 }
 
-func IsStdinTerminal() bool {
-	return terminal.IsTerminal(0)
+// Describes the command to be started in a PTY
+type Command struct {
+	Argv []string
+	// Passed to the command as its argv[0] instead of Argv[0], if set. E.g.: "-bash" to start a
+	// login shell.
+	Arg0 string
+	Env  []string
+	Dir  string
+	// The user the command runs as. The command runs as the user of the server if nil.
+	Credential *syscall.Credential
+	// Runs the command isolated from the host, if set
+	Sandbox *Sandbox
+	// The group the processes of the command are put in, if set. It's removed once they are gone.
+	Cgroup  *Cgroup
+	Rlimits []Rlimit
+	// The path of an existing cgroup the command joins, if set. E.g.: the one of a container.
+	JoinCgroup string
 }
 
-func (pty *PtyMaster) Start(command string, args []string, envVars []string) (err error) {
-	pty.command = exec.Command(command, args...)
-	pty.command.Env = envVars
-	pty.ptyFile, err = ptyDevice.Start(pty.command)
+// A resource limit of the command, as in setrlimit(2). E.g.: syscall.RLIMIT_NOFILE
+type Rlimit struct {
+	Resource int
+	Cur      uint64
+	Max      uint64
+}
 
+func (pty *PtyMaster) Start(command Command) (err error) {
+	if len(command.Argv) == 0 {
+		return errors.New("no command to start")
+	}
+	attrs := &syscall.SysProcAttr{
+		Setsid:  true,
+		Setctty: true,
+	}
+	var gate *os.File
+	if needsInit(command) {
+		if pty.command, gate, err = initCommand(command); err != nil {
+			return
+		}
+		if command.Sandbox != nil {
+			attrs.Cloneflags = command.Sandbox.cloneflags()
+		}
+	} else {
+		pty.command = exec.Command(command.Argv[0], command.Argv[1:]...)
+		if command.Arg0 != "" {
+			pty.command.Args[0] = command.Arg0
+		}
+		pty.command.Env = command.Env
+		pty.command.Dir = command.Dir
+		attrs.Credential = command.Credential
+	}
+
+	// Makes the command init exit, unless the gate was opened
+	if gate != nil {
+		defer openGate(gate, false)
+	}
+	// The command got its copy of those
+	defer func() {
+		for _, file := range pty.command.ExtraFiles {
+			file.Close()
+		}
+	}()
+
+	ptyFile, ttyFile, err := ptyDevice.Open()
+	if err != nil {
+		return
+	}
+	defer ttyFile.Close()
+	cols, rows, _ := pty.GetWinSize()
+	err = ptyDevice.Setsize(ptyFile, &ptyDevice.Winsize{
+		Rows: uint16(rows),
+		Cols: uint16(cols),
+	})
+	if err == nil && command.Credential != nil {
+		// Let the user reopen its terminal, like login does (e.g.: for sudo to prompt for
+		// a password)
+		err = ttyFile.Chown(int(command.Credential.Uid), int(command.Credential.Gid))
+	}
 	if err != nil {
+		ptyFile.Close()
 		return
 	}
 
-	// Set the initial window size
-	cols, rows, err := terminal.GetSize(0)
-	pty.SetWinSize(rows, cols)
+	pty.command.Stdin = ttyFile
+	pty.command.Stdout = ttyFile
+	pty.command.Stderr = ttyFile
+	pty.command.SysProcAttr = attrs
+	if err = pty.command.Start(); err != nil {
+		ptyFile.Close()
+		return
+	}
+	// There is no way to start the command in its group, or with its limits, with this version
+	// of Go. They are applied to the command init instead, before it execs the command.
+	if err = applyLimits(pty.command.Process.Pid, command); err != nil {
+		pty.command.Process.Kill()
+		pty.command.Wait()
+		ptyFile.Close()
+		return
+	}
+	if gate != nil {
+		openGate(gate, true)
+	}
+	pty.cgroup = command.Cgroup
+	pty.ptyFile = ptyFile
+	pty.startedAt = time.Now()
+
+	// Reap the command as soon as it exits, so it doesn't linger as a zombie
+	go func() {
+		pty.waitErr = pty.command.Wait()
+		close(pty.done)
+	}()
 	return
 }
 
-func (pty *PtyMaster) MakeRaw() (err error) {
+func applyLimits(pid int, command Command) error {
+	if command.Cgroup != nil {
+		if err := command.Cgroup.Add(pid); err != nil {
+			return err
+		}
+	}
+	if command.JoinCgroup != "" {
+		if err := (&Cgroup{path: command.JoinCgroup}).Add(pid); err != nil {
+			return err
+		}
+	}
+	for _, rlimit := range command.Rlimits {
+		limit := syscall.Rlimit{Cur: rlimit.Cur, Max: rlimit.Max}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(rlimit.Resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("cannot set the resource limit %d: %w", rlimit.Resource, errno)
+		}
+	}
+	return nil
+}
 
-	// Save the initial state of the terminal, before making it RAW. Note that this terminal is the
-	// terminal under which the tty-share command has been started, and it's identified via the
-	// stdin file descriptor (0 in this case)
-	// We need to make this terminal RAW so that when the command (passed here as a string, a shell
-	// usually), is receiving all the input, including the special characters:
-	// so no SIGINT for Ctrl-C, but the RAW character data, so no line discipline.
-	// Read more here: https://www.linusakesson.net/programming/tty/
-	pty.terminalInitState, err = terminal.MakeRaw(int(os.Stdin.Fd()))
-	return
+// The resources used by the processes of the command, if it was started in a group
+func (pty *PtyMaster) Usage() (*CgroupUsage, error) {
+	if pty.cgroup == nil {
+		return nil, nil
+	}
+	usage, err := pty.cgroup.Usage()
+	return &usage, err
 }
 
-func (pty *PtyMaster) SetWinChangeCB(winChangedCB onWindowChangedCB) {
-	// Start listening for window changes
-	go OnWindowChanges(func(cols, rows int) {
-		// TODO:policy: should the server decide here if we care about the size and set it
-		// right here?
-		pty.SetWinSize(rows, cols)
+// Sets how long Stop waits for the command to exit, before killing it
+func (pty *PtyMaster) SetStopGracePeriod(gracePeriod time.Duration) {
+	pty.stopGracePeriod = gracePeriod
+}
 
-		// Notify the PtyMaster user of the window changes, to be sent to the remote side
-		winChangedCB(cols, rows)
-	})
+// The PID of the running command
+func (pty *PtyMaster) Pid() int {
+	if pty.command == nil || pty.command.Process == nil {
+		return 0
+	}
+	return pty.command.Process.Pid
+}
+
+func (pty *PtyMaster) StartedAt() time.Time {
+	return pty.startedAt
 }
 
 func (pty *PtyMaster) GetWinSize() (int, int, error) {
-	cols, rows, err := terminal.GetSize(0)
-	return cols, rows, err
+	pty.sizeLock.Lock()
+	defer pty.sizeLock.Unlock()
+	return pty.cols, pty.rows, nil
 }
 
 func (pty *PtyMaster) Write(b []byte) (int, error) {
@@ -83,7 +232,22 @@ func (pty *PtyMaster) Read(b []byte) (int, error) {
 	return pty.ptyFile.Read(b)
 }
 
+// Sets the size of the window of this PTY. When called before Start, it sets the size the command
+// is started with.
 func (pty *PtyMaster) SetWinSize(rows, cols int) {
+	if rows <= 0 || cols <= 0 {
+		return
+	}
+	pty.sizeLock.Lock()
+	pty.cols, pty.rows = cols, rows
+	pty.sizeLock.Unlock()
+	pty.setDeviceSize(rows, cols)
+}
+
+func (pty *PtyMaster) setDeviceSize(rows, cols int) {
+	if pty.ptyFile == nil {
+		return
+	}
 	winSize := &ptyDevice.Winsize{
 		Rows: uint16(rows),
 		Cols: uint16(cols),
@@ -100,57 +264,141 @@ func (pty *PtyMaster) Refresh() {
 		return
 	}
 
-	pty.SetWinSize(rows-1, cols)
+	pty.setDeviceSize(rows-1, cols)
 
 	go func() {
 		time.Sleep(time.Millisecond * 50)
-		pty.SetWinSize(rows, cols)
+		// The size might have been changed in the meantime
+		cols, rows, _ := pty.GetWinSize()
+		pty.setDeviceSize(rows, cols)
 	}()
 }
 
+// Waits for the command to exit
 func (pty *PtyMaster) Wait() (err error) {
-	err = pty.command.Wait()
-	return
+	<-pty.done
+	return pty.waitErr
 }
 
-func (pty *PtyMaster) Restore() {
-	terminal.Restore(0, pty.terminalInitState)
-	return
+// The exit code of the command, once it has exited. If the command was terminated by a signal,
+// the code is 128 + the signal number, like in shells, and signal is the name of the signal.
+func (pty *PtyMaster) ExitStatus() (code int, signal string) {
+	<-pty.done
+	if pty.command.ProcessState == nil {
+		return -1, ""
+	}
+	if status, ok := pty.command.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), status.Signal().String()
+	}
+	return pty.command.ProcessState.ExitCode(), ""
+}
+
+// Closed once the command has exited
+func (pty *PtyMaster) Done() <-chan struct{} {
+	return pty.done
 }
 
+// Stops the command and all the processes it started in its session: they first get a SIGHUP,
+// as if the terminal was closed, and a SIGTERM. The ones still running after the grace period are
+// killed. Returns once the command has been reaped. It's safe to call Stop more than once.
 func (pty *PtyMaster) Stop() (err error) {
-	signal.Ignore(syscall.SIGWINCH)
+	if pty.command == nil || pty.command.Process == nil {
+		return
+	}
+	pty.stopOnce.Do(func() {
+		pty.signalSession(syscall.SIGHUP)
+		pty.signalSession(syscall.SIGTERM)
 
-	pty.command.Process.Signal(syscall.SIGTERM)
-	// TODO: Find a proper wai to close the running command. Perhaps have a timeout after which,
-	// if the command hasn't reacted to SIGTERM, then send a SIGKILL
-	// (bash for example doesn't finish if only a SIGTERM has been sent)
-	pty.command.Process.Signal(syscall.SIGKILL)
-	return
+		deadline := time.After(pty.stopGracePeriod)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+	waitLoop:
+		for {
+			select {
+			case <-deadline:
+				break waitLoop
+			case <-ticker.C:
+				if pty.exited() && len(pty.leftProcesses()) == 0 {
+					break waitLoop
+				}
+			}
+		}
+
+		pty.signalSession(syscall.SIGKILL)
+		<-pty.done
+		pty.ptyFile.Close()
+		if pty.cgroup != nil {
+			if err := pty.cgroup.Remove(); err != nil {
+				log.Printf("cannot remove the cgroup %s: %s", pty.cgroup.Path(), err.Error())
+			}
+		}
+	})
+	return pty.waitErr
+}
+
+func (pty *PtyMaster) exited() bool {
+	select {
+	case <-pty.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sends the signal to the process group of the command, and to the processes left in its session.
+// Those can be in other process groups (e.g.: the background jobs of a shell) or orphaned.
+func (pty *PtyMaster) signalSession(sig syscall.Signal) {
+	pid := pty.command.Process.Pid
+	if !pty.exited() {
+		syscall.Kill(-pid, sig)
+	}
+	for _, p := range pty.leftProcesses() {
+		syscall.Kill(p, sig)
+	}
 }
 
-func OnWindowChanges(wcCB onWindowChangedCB) {
-	wcChan := make(chan os.Signal, 1)
-	signal.Notify(wcChan, syscall.SIGWINCH)
-	// The interface for getting window changes from the pty slave to its process, is via signals.
-	// In our case here, the tty-share command (built in this project) is the client, which should
-	// get notified if the terminal window in which it runs has changed. To get that, it needs to
-	// register for SIGWINCH signal, which is used by the kernel to tell process that the window
-	// has changed its dimentions.
-	// Read more here: https://www.linusakesson.net/programming/tty/
-	// Shortly, ioctl calls are used to communicate from the process to the pty slave device,
-	// and signals are used for the communiation in the reverse direction: from the pty slave
-	// device to the process.
-
-	for {
-		select {
-		case <-wcChan:
-			cols, rows, err := terminal.GetSize(0)
-			if err == nil {
-				wcCB(cols, rows)
-			} else {
-				log.Printf("Can't get window size: %s", err.Error())
+// The processes started by the command which are still running, but the command itself. With a
+// cgroup, that includes the ones which left the session of the command (e.g.: daemons).
+func (pty *PtyMaster) leftProcesses() []int {
+	pid := pty.command.Process.Pid
+	pids := sessionProcesses(pid)
+	if pty.cgroup != nil {
+		for _, p := range pty.cgroup.Pids() {
+			if p != pid {
+				pids = append(pids, p)
 			}
 		}
 	}
+	return pids
+}
+
+// Lists the processes in the session sid, except for its leader. The command is started in a new
+// session by the PTY, so its session ID is its PID.
+func sessionProcesses(sid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == sid {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name (2nd field) is in parenthesis and can contain spaces. The session
+		// ID is the 4th field after it: state ppid pgrp session
+		statStr := string(stat)
+		fields := strings.Fields(statStr[strings.LastIndexByte(statStr, ')')+1:])
+		if len(fields) < 4 || fields[0] == "Z" {
+			continue
+		}
+		if processSid, err := strconv.Atoi(fields[3]); err == nil && processSid == sid {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
 }
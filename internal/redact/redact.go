@@ -0,0 +1,193 @@
+package redact
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Masks secrets in text, e.g. in the output of a terminal. The secrets are found with rules: the
+// token rules match secrets on their own (e.g. an access key), and the block rules match the
+// markers around secrets which can span many lines (e.g. a PEM private key).
+
+// A rule matching secrets on their own. If the pattern has groups, only the first one is masked,
+// e.g. the token after "Bearer ".
+type TokenRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// A rule masking everything from a Begin marker to an End marker, both included
+type BlockRule struct {
+	Name  string
+	Begin *regexp.Regexp
+	End   *regexp.Regexp
+}
+
+// The rules built in, by name
+var builtinRules = map[string]func() ([]TokenRule, []BlockRule){
+	"aws": func() ([]TokenRule, []BlockRule) {
+		return []TokenRule{
+			{Name: "aws", Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA|A3T[A-Z0-9])[A-Z0-9]{16}\b`)},
+			{Name: "aws", Pattern: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`)},
+		}, nil
+	},
+	"bearer": func() ([]TokenRule, []BlockRule) {
+		return []TokenRule{
+			{Name: "bearer", Pattern: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{16,}=*)`)},
+		}, nil
+	},
+	"pem": func() ([]TokenRule, []BlockRule) {
+		return nil, []BlockRule{{
+			Name:  "pem",
+			Begin: regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----`),
+			End:   regexp.MustCompile(`-----END [A-Z0-9 ]*PRIVATE KEY-----`),
+		}}
+	},
+}
+
+// The names of the rules built in
+func BuiltinNames() []string {
+	names := make([]string, 0, len(builtinRules))
+	for name := range builtinRules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type Redactor struct {
+	tokens []TokenRule
+	blocks []BlockRule
+}
+
+// Builds a redactor with the rules built in with the names, and with the patterns as token rules
+func New(builtin []string, patterns []string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, name := range builtin {
+		rules, ok := builtinRules[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction rule %s, use one of %v", name, BuiltinNames())
+		}
+		tokens, blocks := rules()
+		r.tokens = append(r.tokens, tokens...)
+		r.blocks = append(r.blocks, blocks...)
+	}
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.tokens = append(r.tokens, TokenRule{Name: "secret", Pattern: compiled})
+	}
+	return r, nil
+}
+
+func mask(name string) []byte {
+	return []byte("[REDACTED:" + name + "]")
+}
+
+// Masks the secrets in a complete text
+func (r *Redactor) String(text string) string {
+	stream := r.Stream()
+	out := stream.Write([]byte(text))
+	return string(append(out, stream.End()...))
+}
+
+// A span of the text to mask
+type span struct {
+	start, end int
+	name       string
+	// The whole match, which can be larger than what is masked
+	matchStart, matchEnd int
+}
+
+// The spans the token rules match in the text, sorted and without overlaps
+func (r *Redactor) tokenSpans(text []byte) []span {
+	var spans []span
+	for _, rule := range r.tokens {
+		for _, loc := range rule.Pattern.FindAllSubmatchIndex(text, -1) {
+			start, end := loc[0], loc[1]
+			if len(loc) >= 4 && loc[2] >= 0 {
+				start, end = loc[2], loc[3]
+			}
+			if start < end {
+				spans = append(spans, span{start: start, end: end, name: rule.Name, matchStart: loc[0], matchEnd: loc[1]})
+			}
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	merged := spans[:0]
+	for _, s := range spans {
+		if n := len(merged); n > 0 && s.start < merged[n-1].end {
+			if s.end > merged[n-1].end {
+				merged[n-1].end = s.end
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+func (r *Redactor) maskTokens(text []byte) []byte {
+	spans := r.tokenSpans(text)
+	if len(spans) == 0 {
+		return text
+	}
+	var out bytes.Buffer
+	last := 0
+	for _, s := range spans {
+		out.Write(text[last:s.start])
+		out.Write(mask(s.name))
+		last = s.end
+	}
+	out.Write(text[last:])
+	return out.Bytes()
+}
+
+// How long the Begin markers of the blocks can be, after their literal prefix
+const maxMarkerLength = 64
+
+// Where the text ends with what can be the beginning of the Begin marker of a block, or its length
+// if it doesn't. Only the markers starting with a literal prefix are recognized, e.g.
+// "-----BEGIN ".
+func (r *Redactor) beginStart(text []byte) int {
+	start := len(text)
+	for i := range r.blocks {
+		prefix, _ := r.blocks[i].Begin.LiteralPrefix()
+		if prefix == "" {
+			continue
+		}
+		// The prefix, and a marker written so far, on a single line
+		if at := bytes.LastIndex(text, []byte(prefix)); at >= 0 && len(text)-at <= len(prefix)+maxMarkerLength &&
+			bytes.IndexByte(text[at:], '\n') < 0 && at < start {
+			start = at
+		}
+		// Some of the prefix
+		for n := len(prefix) - 1; n > 0; n-- {
+			if bytes.HasSuffix(text, []byte(prefix[:n])) {
+				if at := len(text) - n; at < start {
+					start = at
+				}
+				break
+			}
+		}
+	}
+	return start
+}
+
+// The first block rule whose Begin marker is in the text
+func (r *Redactor) firstBlock(text []byte) (*BlockRule, []int) {
+	var found *BlockRule
+	var foundLoc []int
+	for i := range r.blocks {
+		if loc := r.blocks[i].Begin.FindIndex(text); loc != nil && (foundLoc == nil || loc[0] < foundLoc[0]) {
+			found, foundLoc = &r.blocks[i], loc
+		}
+	}
+	return found, foundLoc
+}
@@ -0,0 +1,142 @@
+package redact
+
+import "bytes"
+
+// How much of the text a stream holds back, so that the secrets split across writes are matched
+// whole. The secrets longer than that are only caught if they are not split, but for the blocks.
+const holdBack = 512
+
+// How much of the text a stream holds back inside a block, so that its End marker is matched whole
+const endHoldBack = 64
+
+// Masks the text of a block up to that many bytes, in case its End marker never comes (e.g. the
+// Begin marker was only mentioned)
+const maxBlockLength = 16 << 10
+
+// Masks the secrets in a stream of text, written in chunks which can split the secrets
+type Stream struct {
+	redactor *Redactor
+	pending  []byte
+	// The block being masked, nil outside of the blocks
+	block       *BlockRule
+	blockLength int
+}
+
+func (r *Redactor) Stream() *Stream {
+	return &Stream{redactor: r}
+}
+
+// How much of the text held back is released
+type release int
+
+const (
+	releaseLines release = iota
+	releaseAll
+	releaseEnd
+)
+
+// Returns the part of the text which can be released, with its secrets masked. The end of the text
+// can be held back until the next writes, or until FlushLines or Flush.
+func (s *Stream) Write(p []byte) []byte {
+	return s.process(append(s.pending, p...), nil)
+}
+
+// Releases the complete lines held back, e.g. once the stream has been idle for a moment. The last
+// line is still held back, as it can be the beginning of a secret.
+func (s *Stream) FlushLines() []byte {
+	mode := releaseLines
+	return s.process(s.pending, &mode)
+}
+
+// Releases the text held back, e.g. once the stream has been idle for a while. What can be the
+// beginning of the Begin marker of a block is still held back until the next writes, as well as
+// the End marker of a block being masked.
+func (s *Stream) Flush() []byte {
+	mode := releaseAll
+	return s.process(s.pending, &mode)
+}
+
+// Releases all the text held back, once the stream is over. The text of a block being masked is
+// dropped.
+func (s *Stream) End() []byte {
+	mode := releaseEnd
+	out := s.process(s.pending, &mode)
+	s.pending = nil
+	s.block = nil
+	s.blockLength = 0
+	return out
+}
+
+// Whether some text is held back, which Flush would release
+func (s *Stream) Pending() bool {
+	return s.block == nil && s.redactor.beginStart(s.pending) > 0
+}
+
+func (s *Stream) process(text []byte, flush *release) []byte {
+	var out []byte
+	for {
+		if s.block != nil {
+			loc := s.block.End.FindIndex(text)
+			if loc == nil && s.blockLength+len(text) < maxBlockLength {
+				// Nothing is released inside the block
+				if len(text) > endHoldBack {
+					s.blockLength += len(text) - endHoldBack
+					text = text[len(text)-endHoldBack:]
+				}
+				s.pending = append([]byte(nil), text...)
+				return out
+			}
+			if loc == nil {
+				end := maxBlockLength - s.blockLength
+				if end < 0 {
+					end = 0
+				}
+				loc = []int{end, end}
+			}
+			text = text[loc[1]:]
+			s.block = nil
+			s.blockLength = 0
+			continue
+		}
+
+		if block, loc := s.redactor.firstBlock(text); block != nil {
+			out = append(out, s.redactor.maskTokens(text[:loc[0]])...)
+			out = append(out, mask(block.Name)...)
+			s.block = block
+			text = text[loc[1]:]
+			continue
+		}
+		var cut int
+		switch {
+		case flush == nil:
+			cut = s.cut(text, len(text)-holdBack)
+		case *flush == releaseLines:
+			cut = bytes.LastIndexByte(text, '\n') + 1
+			if start := s.redactor.beginStart(text); start < cut {
+				cut = start
+			}
+			cut = s.cut(text, cut)
+		case *flush == releaseAll:
+			cut = s.cut(text, s.redactor.beginStart(text))
+		default:
+			cut = len(text)
+		}
+		out = append(out, s.redactor.maskTokens(text[:cut])...)
+		s.pending = append([]byte(nil), text[cut:]...)
+		return out
+	}
+}
+
+// Where the text can be cut to release its beginning: at the latest at cut, and not through a
+// secret
+func (s *Stream) cut(text []byte, cut int) int {
+	if cut <= 0 {
+		return 0
+	}
+	for _, span := range s.redactor.tokenSpans(text) {
+		if span.matchStart < cut && span.matchEnd > cut {
+			cut = span.matchStart
+		}
+	}
+	return cut
+}
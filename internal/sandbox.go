@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Runs a command in new mount, PID, UTS and IPC namespaces, so that it can neither see nor signal
+// the processes of the host, with a read-only view of the file systems except for a scratch
+// directory. The server needs to run as root for that.
+type Sandbox struct {
+	// Directory mounted read-only as the root of the command. Defaults to "/".
+	Root string
+	// Directory of the sandbox the command can write to, e.g. "/tmp". A new tmpfs is mounted
+	// there, unless ScratchDir is set. Nothing is writable if empty.
+	Scratch string
+	// Directory of the host mounted at Scratch, instead of a tmpfs
+	ScratchDir string
+	Hostname   string
+	// Run the command in a new network namespace, with a loopback interface only
+	IsolateNetwork bool
+}
+
+// Where the sandboxes stage their root, on the host. Only root can write to it.
+const stagingParent = "/run/remotecommand"
+
+func (sandbox *Sandbox) cloneflags() uintptr {
+	flags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC)
+	if sandbox.IsolateNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return flags
+}
+
+// Sets the sandbox up, from its init. The command is started in the new namespaces.
+func (sandbox *Sandbox) setup() error {
+	if sandbox.Hostname != "" {
+		if err := syscall.Sethostname([]byte(sandbox.Hostname)); err != nil {
+			return fmt.Errorf("cannot set the hostname: %w", err)
+		}
+	}
+	if sandbox.IsolateNetwork {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("cannot bring the loopback interface up: %w", err)
+		}
+	}
+	return sandboxMounts(sandbox)
+}
+
+// Makes the root of the sandbox the root of the process, read-only, with its own /proc and the
+// scratch directory writable
+func sandboxMounts(sandbox *Sandbox) error {
+	root := sandbox.Root
+	if root == "" {
+		root = "/"
+	}
+
+	// Keep the mounts below from propagating to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("cannot make the mounts private: %w", err)
+	}
+	// pivot_root needs the new root to be a mount point, which can't be bound on "/" itself. It's
+	// bound on a directory of a tmpfs only mounted in the sandbox, itself on a directory only root
+	// can get to, removed once the root is changed.
+	if err := makeStagingParent(); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(stagingParent, "sandbox-")
+	if err != nil {
+		return fmt.Errorf("cannot create the staging directory: %w", err)
+	}
+	parent, err := os.Open(stagingParent)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	if err := syscall.Mount("tmpfs", staging, "tmpfs", 0, "mode=0700"); err != nil {
+		return fmt.Errorf("cannot mount a tmpfs on %s: %w", staging, err)
+	}
+	newRoot := filepath.Join(staging, "root")
+	if err := os.Mkdir(newRoot, 0700); err != nil {
+		return err
+	}
+	if err = syscall.Mount(root, newRoot, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("cannot mount the root %s: %w", root, err)
+	}
+
+	if sandbox.Scratch != "" {
+		target := filepath.Join(newRoot, sandbox.Scratch)
+		if sandbox.ScratchDir != "" {
+			err = syscall.Mount(sandbox.ScratchDir, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		} else {
+			err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+		}
+		if err != nil {
+			return fmt.Errorf("cannot mount the scratch directory %s: %w", sandbox.Scratch, err)
+		}
+	}
+	// The commands need the devices of the PTY and the likes of /dev/null
+	if root != "/" {
+		if err := syscall.Mount("/dev", filepath.Join(newRoot, "dev"), "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("cannot mount /dev: %w", err)
+		}
+	}
+	// Only the processes of the sandbox are visible in its own /proc
+	if err := syscall.Mount("proc", filepath.Join(newRoot, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("cannot mount /proc: %w", err)
+	}
+
+	if err := os.Chdir(newRoot); err != nil {
+		return err
+	}
+	// Stacks the old root on top of the new one, so that it can be detached right away
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("cannot change the root: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("cannot detach the old root: %w", err)
+	}
+	if err := removeStaging(parent, staging); err != nil {
+		return err
+	}
+	return remountReadOnly(sandbox.Scratch)
+}
+
+// Creates the parent of the staging directories, if needed, and makes sure no one else than root
+// can write to it
+func makeStagingParent() error {
+	if err := os.Mkdir(stagingParent, 0700); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("cannot create %s: %w", stagingParent, err)
+	}
+	info, err := os.Lstat(stagingParent)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || stat.Uid != 0 || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s must be a directory owned by root, that only root can write to", stagingParent)
+	}
+	return nil
+}
+
+// Removes the staging directory, from the host through its parent, once the root is changed. The
+// copy of its tmpfs found in the sandbox, when the host's root is bound as its root, is unmounted
+// first.
+func removeStaging(parent *os.File, staging string) error {
+	if err := syscall.Unmount(staging, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+		return fmt.Errorf("cannot unmount %s: %w", staging, err)
+	}
+	if err := syscall.Fchdir(int(parent.Fd())); err != nil {
+		return err
+	}
+	if err := syscall.Rmdir(filepath.Base(staging)); err != nil {
+		return fmt.Errorf("cannot remove %s: %w", staging, err)
+	}
+	return os.Chdir("/")
+}
+
+// Remounts the file systems of the sandbox read-only, except for the scratch directory and the
+// pseudo file systems of /proc and /dev
+func remountReadOnly(scratch string) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writable := []string{"/proc", "/dev"}
+	if scratch != "" {
+		writable = append(writable, filepath.Clean(scratch))
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mount-point options ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || underAny(fields[4], writable) {
+			continue
+		}
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		// The flags not repeated are cleared by the remount, which isn't allowed for some
+		for _, option := range strings.Split(fields[5], ",") {
+			switch option {
+			case "nosuid":
+				flags |= syscall.MS_NOSUID
+			case "nodev":
+				flags |= syscall.MS_NODEV
+			case "noexec":
+				flags |= syscall.MS_NOEXEC
+			}
+		}
+		if err := syscall.Mount("", fields[4], "", flags, ""); err != nil {
+			return fmt.Errorf("cannot remount %s read-only: %w", fields[4], err)
+		}
+	}
+	return scanner.Err()
+}
+
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// A new network namespace has its loopback interface down
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// struct ifreq, with the flags in its union
+	var ifreq struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifreq.name[:], "lo")
+	ifreq.flags = syscall.IFF_UP | syscall.IFF_LOOPBACK | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifreq))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The shortest prefix of a container ID accepted as a target, as shown by docker ps
+const minContainerIDPrefix = 12
+
+var (
+	// Where the processes are looked up
+	procDir = "/proc"
+	// Where Docker keeps the configuration of the containers, which maps their names to their IDs
+	dockerContainersDir = "/var/lib/docker/containers"
+)
+
+// Finds the process whose namespaces a session enters. The target is either a PID, or the name or
+// ID of a container, in which case its first process is returned. Containers are recognized by
+// their ID in the cgroups of their processes: the ID can be shortened, down to 12 characters. The
+// names are only looked up in the configuration of the runtime, never in what the processes can
+// set themselves (e.g.: their hostname). Only the processes in another mount namespace than the
+// server are considered, to leave out the runtimes starting the containers.
+func ResolveTarget(target string) (int, error) {
+	if target == "" {
+		return 0, errors.New("no target")
+	}
+	if pid, err := strconv.Atoi(target); err == nil {
+		if pid <= 0 {
+			return 0, fmt.Errorf("invalid target PID %d", pid)
+		}
+		if _, err := os.Stat(filepath.Join(procDir, target)); err != nil {
+			return 0, fmt.Errorf("no process with the PID %d", pid)
+		}
+		return pid, nil
+	}
+	id, err := containerID(target)
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return 0, err
+	}
+	ownMountNS, _ := os.Readlink(filepath.Join(procDir, "self", "ns", "mnt"))
+	ownPidNS, _ := os.Readlink(filepath.Join(procDir, "self", "ns", "pid"))
+	// The processes of the container are preferred to the ones which only share some of its
+	// namespaces (e.g.: unshare). The entries are sorted by name, not by PID.
+	found, foundScore := 0, 0
+	containers := map[string]bool{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		mountNS, err := os.Readlink(filepath.Join(procDir, entry.Name(), "ns", "mnt"))
+		if err != nil || mountNS == ownMountNS {
+			continue
+		}
+		container := containerOf(pid, id)
+		if container == "" {
+			continue
+		}
+		containers[container] = true
+		score := 1
+		if pidNS, err := os.Readlink(filepath.Join(procDir, entry.Name(), "ns", "pid")); err == nil && pidNS != ownPidNS {
+			score = 2
+		}
+		if score > foundScore || (score == foundScore && pid < found) {
+			found, foundScore = pid, score
+		}
+	}
+	if len(containers) > 1 {
+		return 0, fmt.Errorf("the container ID %s is ambiguous, it matches %d containers", target, len(containers))
+	}
+	if found == 0 {
+		return 0, fmt.Errorf("no container %s", target)
+	}
+	return found, nil
+}
+
+// The ID, or the prefix of the ID, of the container with the name or the ID
+func containerID(container string) (string, error) {
+	if isContainerID(container) && len(container) >= minContainerIDPrefix {
+		return container, nil
+	}
+	entries, err := os.ReadDir(dockerContainersDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dockerContainersDir, entry.Name(), "config.v2.json"))
+		if err != nil {
+			continue
+		}
+		var config struct {
+			ID   string
+			Name string
+		}
+		if json.Unmarshal(content, &config) == nil && config.Name == "/"+container && isContainerID(config.ID) {
+			return config.ID, nil
+		}
+	}
+	if isContainerID(container) {
+		return "", fmt.Errorf("no container named %s, and at least %d characters of an ID are needed", container, minContainerIDPrefix)
+	}
+	return "", fmt.Errorf("no container named %s, use the ID of the container instead", container)
+}
+
+// Whether the text looks like the ID of a container, or like a prefix of one
+func isContainerID(text string) bool {
+	if text == "" || len(text) > 64 {
+		return false
+	}
+	for _, r := range text {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// The full ID of the container of the process, if it starts with the prefix
+func containerOf(pid int, prefix string) string {
+	cgroups, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	// E.g.: 0::/system.slice/docker-<id>.scope, or 0::/docker/<id>
+	for _, path := range strings.Split(string(cgroups), "\n") {
+		for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '-' || r == '.' || r == ':' }) {
+			if len(part) == 64 && isContainerID(part) && strings.HasPrefix(part, prefix) {
+				return part
+			}
+		}
+	}
+	return ""
+}
+
+// The cgroup v2 group of the process
+func CgroupOf(pid int) (string, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	cgroups, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(cgroups), "\n") {
+		if path := strings.TrimPrefix(line, "0::"); path != line {
+			// The group is outside of the cgroup namespace of the server
+			if strings.HasPrefix(path, "/..") {
+				return "", fmt.Errorf("the cgroup of the process %d is not visible to the server", pid)
+			}
+			return filepath.Join(mount, path), nil
+		}
+	}
+	return "", fmt.Errorf("the process %d is not in a cgroup v2 group", pid)
+}
+
+// Where the cgroup v2 hierarchy is mounted, usually /sys/fs/cgroup
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mount-point options [optional fields] - type source ...
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && i > 4 {
+				if fields[i+1] == "cgroup2" {
+					return fields[4], nil
+				}
+				break
+			}
+		}
+	}
+	return "", errors.New("the cgroup v2 hierarchy is not mounted")
+}
+
+// The command running argv in the namespaces of the process, with nsenter, and the credential
+// nsenter runs with. nsenter has to be root to enter the namespaces: it switches to the uid of the
+// credential, if not nil, once in them, keeping the gid and the groups it was started with, which
+// --setgid would drop. The working directory is dir in the namespaces, or the one of the process
+// if dir is empty.
+func EnterCommand(pid int, argv []string, dir string, credential *syscall.Credential) ([]string, *syscall.Credential, error) {
+	nsenter, err := exec.LookPath("nsenter")
+	if err != nil {
+		return nil, nil, err
+	}
+	enter := []string{nsenter, "--target", strconv.Itoa(pid), "--mount", "--uts", "--ipc", "--net", "--pid"}
+	if dir != "" {
+		// --wd would look the directory up on the host
+		if !nsenterHasWdns(nsenter) {
+			return nil, nil, fmt.Errorf("cannot start in %s in the namespaces of the process %d: %s has no --wdns, util-linux 2.38 or later is needed", dir, pid, nsenter)
+		}
+		enter = append(enter, "--wdns="+dir)
+	} else {
+		enter = append(enter, "--wd")
+	}
+	var enterCredential *syscall.Credential
+	if credential != nil {
+		enter = append(enter, "--setuid", strconv.FormatUint(uint64(credential.Uid), 10))
+		enterCredential = &syscall.Credential{Uid: 0, Gid: credential.Gid, Groups: credential.Groups}
+	}
+	return append(append(enter, "--"), argv...), enterCredential, nil
+}
+
+// Whether nsenter can set the working directory in the namespaces it enters, since util-linux 2.38
+func nsenterHasWdns(nsenter string) bool {
+	help, err := exec.Command(nsenter, "--help").Output()
+	return err == nil && bytes.Contains(help, []byte("--wdns"))
+}
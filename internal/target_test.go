@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+var (
+	// Two containers whose IDs share their first 12 characters
+	webID   = "0123456789ab" + "c" + strings.Repeat("0", 51)
+	dbID    = "0123456789ab" + "d" + strings.Repeat("0", 51)
+	cacheID = "fedcba987654" + "3" + strings.Repeat("0", 51)
+)
+
+// A process of the fake /proc
+type fakeProcess struct {
+	pid     int
+	mountNS string
+	pidNS   string
+	cgroup  string
+}
+
+// Makes a fake /proc, in which the server runs in the host namespaces, and a fake configuration
+// of Docker for the containers with the names
+func fakeHost(t *testing.T, processes []fakeProcess, names map[string]string) {
+	root := t.TempDir()
+	write := func(path, content string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(path, target string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	processes = append(processes, fakeProcess{pid: 1, mountNS: "host", pidNS: "host", cgroup: "/init.scope"})
+	for _, process := range processes {
+		dir := filepath.Join(root, "proc", strconv.Itoa(process.pid))
+		link(filepath.Join(dir, "ns", "mnt"), "mnt:["+process.mountNS+"]")
+		link(filepath.Join(dir, "ns", "pid"), "pid:["+process.pidNS+"]")
+		write(filepath.Join(dir, "cgroup"), "0::"+process.cgroup+"\n")
+	}
+	link(filepath.Join(root, "proc", "self"), "1")
+	write(filepath.Join(root, "proc", "cpuinfo"), "")
+	for name, id := range names {
+		write(filepath.Join(root, "docker", id, "config.v2.json"), fmt.Sprintf(`{"ID":%q,"Name":"/%s","Config":{"Hostname":"x"}}`, id, name))
+	}
+
+	previousProc, previousDocker := procDir, dockerContainersDir
+	procDir, dockerContainersDir = filepath.Join(root, "proc"), filepath.Join(root, "docker")
+	t.Cleanup(func() {
+		procDir, dockerContainersDir = previousProc, previousDocker
+	})
+}
+
+func TestResolveTarget(t *testing.T) {
+	fakeHost(t, []fakeProcess{
+		// The runtime, in the namespaces of the host
+		{pid: 90, mountNS: "host", pidNS: "host", cgroup: "/system.slice/docker-" + webID + ".scope"},
+		{pid: 120, mountNS: "web", pidNS: "web", cgroup: "/system.slice/docker-" + webID + ".scope"},
+		{pid: 100, mountNS: "web", pidNS: "web", cgroup: "/system.slice/docker-" + webID + ".scope"},
+		// Only shares the mount namespace of the container
+		{pid: 50, mountNS: "web", pidNS: "host", cgroup: "/system.slice/docker-" + webID + ".scope"},
+		{pid: 200, mountNS: "db", pidNS: "db", cgroup: "/docker/" + dbID},
+		{pid: 300, mountNS: "cache", pidNS: "cache", cgroup: "/system.slice/docker-" + cacheID + ".scope"},
+		// Not in a container
+		{pid: 400, mountNS: "other", pidNS: "other", cgroup: "/user.slice/session-1.scope"},
+	}, map[string]string{"web": webID, "db": dbID, "cache": cacheID, "gone": strings.Repeat("9", 64)})
+
+	tests := []struct {
+		target string
+		pid    int
+		// Part of the error, empty if resolved
+		err string
+	}{
+		{"400", 400, ""},
+		{"1", 1, ""},
+		{"0", 0, "invalid target PID"},
+		{"-1", 0, "invalid target PID"},
+		{"999", 0, "no process with the PID"},
+		{webID, 100, ""},
+		{webID[:13], 100, ""},
+		{dbID[:13], 200, ""},
+		{cacheID[:12], 300, ""},
+		{"web", 100, ""},
+		{"db", 200, ""},
+		{webID[:12], 0, "ambiguous, it matches 2 containers"},
+		{cacheID[:11], 0, "at least 12 characters"},
+		{"fed", 0, "at least 12 characters"},
+		{"box", 0, "no container named box, use the ID"},
+		{"gone", 0, "no container gone"},
+		{strings.Repeat("a", 64), 0, "no container"},
+		{"", 0, "no target"},
+	}
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			pid, err := ResolveTarget(test.target)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want it to mention %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if pid != test.pid {
+				t.Errorf("pid = %d, want %d", pid, test.pid)
+			}
+		})
+	}
+}
+
+func TestIsContainerID(t *testing.T) {
+	for text, want := range map[string]bool{
+		webID:                   true,
+		webID[:12]:              true,
+		"0":                     true,
+		"":                      false,
+		webID + "0":             false,
+		"0123456789AB":          false,
+		"web":                   false,
+		"0123456789ab-c":        false,
+		"/" + webID[:12]:        false,
+		strings.Repeat("g", 12): false,
+	} {
+		if got := isContainerID(text); got != want {
+			t.Errorf("isContainerID(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+// Puts a fake nsenter first in the PATH, which has --wdns if wdns
+func fakeNsenter(t *testing.T, wdns bool) string {
+	dir := t.TempDir()
+	help := "echo ' -w, --wd[=<dir>]       set the working directory'"
+	if wdns {
+		help += "; echo ' -W. --wdns <dir>       set the working directory in namespace'"
+	}
+	nsenter := filepath.Join(dir, "nsenter")
+	if err := os.WriteFile(nsenter, []byte("#!/bin/sh\n"+help+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() {
+		os.Setenv("PATH", path)
+	})
+	return nsenter
+}
+
+func TestEnterCommand(t *testing.T) {
+	credential := &syscall.Credential{Uid: 1000, Gid: 1000, Groups: []uint32{27, 100}}
+	tests := []struct {
+		name       string
+		wdns       bool
+		dir        string
+		credential *syscall.Credential
+		// After nsenter and its target, empty if the command can't be entered
+		args []string
+		// The credential nsenter runs with
+		enterCredential *syscall.Credential
+	}{
+		{"working directory of the target", false, "", nil, []string{"--wd", "--", "bash"}, nil},
+		{"directory", true, "/srv", nil, []string{"--wdns=/srv", "--", "bash"}, nil},
+		{"directory without --wdns", false, "/srv", nil, nil, nil},
+		{"account", true, "", credential, []string{"--wd", "--setuid", "1000", "--", "bash"}, &syscall.Credential{Gid: 1000, Groups: []uint32{27, 100}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nsenter := fakeNsenter(t, test.wdns)
+			argv, enterCredential, err := EnterCommand(42, []string{"bash"}, test.dir, test.credential)
+			if test.args == nil {
+				if err == nil || !strings.Contains(err.Error(), "util-linux 2.38") {
+					t.Fatalf("error = %v, want nsenter to be too old", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			want := append([]string{nsenter, "--target", "42", "--mount", "--uts", "--ipc", "--net", "--pid"}, test.args...)
+			if !reflect.DeepEqual(argv, want) {
+				t.Errorf("argv = %q, want %q", argv, want)
+			}
+			if !reflect.DeepEqual(enterCredential, test.enterCredential) {
+				t.Errorf("credential = %+v, want %+v", enterCredential, test.enterCredential)
+			}
+		})
+	}
+}
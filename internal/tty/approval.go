@@ -0,0 +1,141 @@
+package tty
+
+import (
+	"log"
+	"time"
+
+	"github.com/gg-tools/remotecommand/internal/audit"
+)
+
+// In the sessions requiring it, the connections joining wait in a pending state, without getting
+// any output and with their input dropped, until an owner of the session lets them in.
+
+// How long a connection waits for an owner to let it in, before being turned away
+const joinApprovalTimeout = 2 * time.Minute
+
+const noOwnerReason = "No owner of the session is connected to let you in."
+
+func (session *TTYShareSession) admitted(rcv *participant) bool {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+	return rcv.el != nil
+}
+
+// Puts a participant on hold, and asks the owners of the session to let it in
+func (session *TTYShareSession) waitApproval(rcv *participant) {
+	log.Printf("%s asks to join as %s", rcv.name(), rcv.role)
+	session.emit(rcv.event(audit.JoinRequested))
+	rcv.proto.SetJoinStatus(JoinPending, "Waiting for an owner of the session to let you in ..")
+	session.announceJoinRequests()
+}
+
+// Lets the pending participant with the ID in the session, or turns it away with the reason.
+// Returns false if no such participant is waiting.
+func (session *TTYShareSession) decideJoin(id string, approve bool, reason string) bool {
+	session.mainRWLock.Lock()
+	var rcv *participant
+	for i, pending := range session.pending {
+		if pending.id == id {
+			rcv = pending
+			session.pending = append(session.pending[:i], session.pending[i+1:]...)
+			break
+		}
+	}
+	if rcv != nil && approve {
+		rcv.el = session.ttyProtoConnections.PushBack(rcv)
+	}
+	session.mainRWLock.Unlock()
+
+	if rcv == nil {
+		return false
+	}
+	rcv.approvalTimer.Stop()
+	session.announceJoinRequests()
+
+	if !approve {
+		session.deny(rcv, reason)
+		return true
+	}
+	log.Printf("%s was let in", rcv.name())
+	rcv.proto.SetJoinStatus(JoinApproved, "")
+	session.welcome(rcv)
+	session.ptyHandler.Refresh()
+	return true
+}
+
+// Whether an owner of the session is attached to it, who can let the others in
+func (session *TTYShareSession) OwnerConnected() bool {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+	return session.ownerConnectedLocked()
+}
+
+func (session *TTYShareSession) ownerConnectedLocked() bool {
+	for e := session.ttyProtoConnections.Front(); e != nil; e = e.Next() {
+		if e.Value.(*participant).owner {
+			return true
+		}
+	}
+	return false
+}
+
+// Turns away a participant who asked to join
+func (session *TTYShareSession) deny(rcv *participant, reason string) {
+	log.Printf("%s was turned away: %s", rcv.name(), reason)
+	event := rcv.event(audit.JoinDenied)
+	event.Reason = reason
+	session.emit(event)
+	rcv.proto.SetJoinStatus(JoinDenied, reason)
+	rcv.ws.Close()
+}
+
+// Turns away the participants waiting to be let in, once no owner is left to do it
+func (session *TTYShareSession) denyPendingWithoutOwner() {
+	session.mainRWLock.RLock()
+	var ids []string
+	if !session.ownerConnectedLocked() {
+		for _, rcv := range session.pending {
+			ids = append(ids, rcv.id)
+		}
+	}
+	session.mainRWLock.RUnlock()
+	for _, id := range ids {
+		session.decideJoin(id, false, noOwnerReason)
+	}
+}
+
+func (session *TTYShareSession) handleJoinDecision(rcv *participant, id string, approve bool) {
+	if !rcv.owner {
+		rcv.proto.Notice("Only the owners of the session can let the others in.")
+		return
+	}
+	reason := ""
+	if !approve {
+		reason = "An owner of the session turned you away."
+	}
+	if !session.decideJoin(id, approve, reason) {
+		rcv.proto.Notice("Nobody is waiting to join with the ID " + id + ".")
+	}
+}
+
+func (session *TTYShareSession) joinRequests() []JoinRequest {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+
+	requests := []JoinRequest{}
+	for _, rcv := range session.pending {
+		requests = append(requests, JoinRequest{ID: rcv.id, Name: rcv.name(), Role: rcv.role})
+	}
+	return requests
+}
+
+// Lets the owners of the session know who is waiting to join it
+func (session *TTYShareSession) announceJoinRequests() {
+	requests := session.joinRequests()
+	session.forEachReceiverLock(func(rcv *participant) bool {
+		if rcv.owner {
+			rcv.proto.SetJoinRequests(requests)
+		}
+		return true
+	})
+}
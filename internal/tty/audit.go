@@ -0,0 +1,46 @@
+package tty
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gg-tools/remotecommand/internal/audit"
+)
+
+// Sends the events of the session to the emitter, tagged with the ID of the session
+func (session *TTYShareSession) SetAudit(emitter *audit.Emitter, sessionID string) {
+	session.mainRWLock.Lock()
+	session.audit = emitter
+	session.id = sessionID
+	session.mainRWLock.Unlock()
+}
+
+func (session *TTYShareSession) emit(event audit.Event) {
+	session.mainRWLock.RLock()
+	emitter := session.audit
+	event.Session = session.id
+	session.mainRWLock.RUnlock()
+	emitter.Emit(event)
+}
+
+// An event about the participant
+func (rcv *participant) event(eventType string) audit.Event {
+	return audit.Event{
+		Type:        eventType,
+		Participant: rcv.id,
+		Identity:    rcv.identity,
+		RemoteAddr:  rcv.remoteAddr,
+		Role:        string(rcv.role),
+		Owner:       rcv.owner,
+	}
+}
+
+// The event of the participant leaving the session, with what went through its connection
+func (rcv *participant) leftEvent() audit.Event {
+	event := rcv.event(audit.ParticipantLeft)
+	bytesIn, bytesOut := atomic.LoadInt64(&rcv.bytesIn), atomic.LoadInt64(&rcv.bytesOut)
+	event.BytesIn = &bytesIn
+	event.BytesOut = &bytesOut
+	event.DurationSeconds = time.Since(rcv.joinedAt).Seconds()
+	return event
+}
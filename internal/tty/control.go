@@ -0,0 +1,203 @@
+package tty
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/gg-tools/remotecommand/internal/audit"
+)
+
+// Only one participant at a time, the driver, has its input forwarded to the PTY. The other
+// participants with the driver role can ask for the control, which the driver or the owners of
+// the session can grant them.
+
+// The name of a participant, as shown to the other ones
+func (rcv *participant) name() string {
+	name := rcv.identity
+	if name == "" {
+		name = rcv.remoteAddr
+	}
+	return fmt.Sprintf("%s (%s)", name, rcv.id)
+}
+
+func (session *TTYShareSession) isDriving(rcv *participant) bool {
+	session.controlLock.Lock()
+	defer session.controlLock.Unlock()
+	return session.driver == rcv
+}
+
+// Lets a participant know, once, that its input is dropped because it's not driving
+func (session *TTYShareSession) warnNotDriving(rcv *participant) {
+	session.controlLock.Lock()
+	warn := !rcv.warnedNotDriving
+	rcv.warnedNotDriving = true
+	session.controlLock.Unlock()
+
+	if warn {
+		rcv.proto.Notice(fmt.Sprintf("You are not driving, your input is ignored. Press %s to request the control.", requestKeysHelp))
+	}
+}
+
+// The keys the clients press for the control actions, shown in the notices
+const (
+	requestKeysHelp = "Ctrl-] r"
+	grantKeysHelp   = "Ctrl-] g"
+)
+
+// Gives the control to the participant joining the session, if nobody is driving
+func (session *TTYShareSession) controlJoin(rcv *participant) {
+	session.controlLock.Lock()
+	changed := session.driver == nil && rcv.role == RoleDriver
+	if changed {
+		session.driver = rcv
+	}
+	driver := session.driver
+	session.controlLock.Unlock()
+
+	if changed {
+		session.announceDriver()
+	} else if driver != nil {
+		rcv.proto.SetDriver(driver.name(), false)
+	} else {
+		rcv.proto.SetDriver("", false)
+	}
+}
+
+// Hands the control over to an owner when the driver leaves the session
+func (session *TTYShareSession) controlLeave(rcv *participant) {
+	session.controlLock.Lock()
+	if session.requester == rcv {
+		session.requester = nil
+	}
+	changed := session.driver == rcv
+	if changed {
+		session.driver = nil
+		session.forEachReceiverLock(func(other *participant) bool {
+			if other != rcv && other.owner && other.role == RoleDriver {
+				session.driver = other
+				return false
+			}
+			return true
+		})
+	}
+	session.controlLock.Unlock()
+
+	if changed {
+		session.announceDriver()
+	}
+}
+
+func (session *TTYShareSession) handleControl(rcv *participant, action, target string) {
+	if rcv.role != RoleDriver {
+		rcv.proto.Notice("Viewers cannot drive the session.")
+		return
+	}
+
+	session.controlLock.Lock()
+	var notices []func()
+	changed := false
+	notify := func(to *participant, text string) {
+		notices = append(notices, func() { to.proto.Notice(text) })
+	}
+
+	switch action {
+	case ControlRequest:
+		switch {
+		case session.driver == nil:
+			session.driver = rcv
+			changed = true
+		case session.driver == rcv:
+			notify(rcv, "You are already driving.")
+		default:
+			session.requester = rcv
+			notify(rcv, fmt.Sprintf("Your request for the control was sent to %s.", session.driver.name()))
+			text := fmt.Sprintf("%s asks for the control. Press %s to grant it.", rcv.name(), grantKeysHelp)
+			notify(session.driver, text)
+			session.forEachReceiverLock(func(other *participant) bool {
+				if other.owner && other != session.driver && other != rcv {
+					notify(other, text)
+				}
+				return true
+			})
+		}
+	case ControlRelease:
+		if session.driver == rcv {
+			// Hand it over to whoever asked for it
+			session.driver = session.requester
+			session.requester = nil
+			changed = true
+		}
+	case ControlGrant:
+		if session.driver != rcv && !rcv.owner {
+			notify(rcv, "Only the driver and the owners of the session can grant the control.")
+			break
+		}
+		to := session.requester
+		if target != "" {
+			to = session.findParticipant(target)
+		}
+		if to == nil || to.role != RoleDriver {
+			notify(rcv, "There is nobody to grant the control to.")
+			break
+		}
+		session.driver = to
+		session.requester = nil
+		changed = true
+	case ControlRevoke:
+		if !rcv.owner {
+			notify(rcv, "Only the owners of the session can take the control back.")
+			break
+		}
+		if session.driver != rcv {
+			session.driver = rcv
+			changed = true
+		}
+	default:
+		notify(rcv, "Unknown control action: "+action)
+	}
+	session.controlLock.Unlock()
+
+	for _, notice := range notices {
+		notice()
+	}
+	if changed {
+		session.announceDriver()
+	}
+}
+
+func (session *TTYShareSession) findParticipant(id string) (found *participant) {
+	session.forEachReceiverLock(func(rcv *participant) bool {
+		if rcv.id == id {
+			found = rcv
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// Lets all the participants know who is driving
+func (session *TTYShareSession) announceDriver() {
+	session.controlLock.Lock()
+	driver := session.driver
+	driverName := ""
+	if driver != nil {
+		driverName = driver.name()
+	}
+	session.forEachReceiverLock(func(rcv *participant) bool {
+		rcv.warnedNotDriving = false
+		return true
+	})
+	session.controlLock.Unlock()
+
+	log.Printf("Driver: %s", driverName)
+	event := audit.Event{Type: audit.ControlChanged}
+	if driver != nil {
+		event = driver.event(audit.ControlChanged)
+	}
+	session.emit(event)
+	session.forEachReceiverLock(func(rcv *participant) bool {
+		rcv.proto.SetDriver(driverName, rcv == driver)
+		return true
+	})
+}
@@ -0,0 +1,405 @@
+package tty
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gg-tools/remotecommand/internal/audit"
+)
+
+// The input of the driver can be checked against rules before it reaches the PTY. The command line
+// being typed is rebuilt from the keys, the way a shell's line editor would, and checked when Enter
+// is pressed. The keys are forwarded as they are typed: only Enter is held back.
+
+// What happens when a command line matches a rule
+type InputAction string
+
+const (
+	// The line is discarded, and not run
+	InputBlock InputAction = "block"
+	// The line is run, and the typist is warned
+	InputWarn InputAction = "warn"
+	// The line is only run if Enter is pressed a second time
+	InputConfirm InputAction = "confirm"
+)
+
+func ParseInputAction(action string) (InputAction, error) {
+	switch InputAction(action) {
+	case InputBlock, InputWarn, InputConfirm:
+		return InputAction(action), nil
+	}
+	return "", fmt.Errorf("unknown input action: %s", action)
+}
+
+type InputRule struct {
+	Pattern *regexp.Regexp
+	Action  InputAction
+	// Shown to the typist, e.g. why the command is dangerous
+	Message string
+}
+
+func (rule *InputRule) describe() string {
+	if rule.Message != "" {
+		return rule.Message
+	}
+	return "the command matches " + rule.Pattern.String()
+}
+
+// What the shells do with the keys, as far as the line being typed is concerned
+const (
+	keyCtrlA     = 0x01
+	keyCtrlB     = 0x02
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyCtrlE     = 0x05
+	keyCtrlF     = 0x06
+	keyBackspace = 0x08
+	keyTab       = 0x09
+	keyLF        = 0x0a
+	keyCtrlK     = 0x0b
+	keyCR        = 0x0d
+	keyCtrlN     = 0x0e
+	keyCtrlP     = 0x10
+	keyCtrlR     = 0x12
+	keyCtrlU     = 0x15
+	keyCtrlW     = 0x17
+	keyCtrlY     = 0x19
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// Sent to the PTY instead of Enter to discard a blocked line: move to its end, and erase it
+var discardLine = []byte{keyCtrlE, keyCtrlU}
+
+// Rebuilds the line being typed out of the keys
+type lineEditor struct {
+	line   []rune
+	cursor int
+	// The bytes of an incomplete UTF-8 character, or of an escape sequence
+	partial []byte
+	escape  bool
+	// Inside a bracketed paste, where Enter is part of the text
+	paste bool
+	// Whether the line was changed in ways which can't be followed, e.g. by recalling the
+	// history or by completion. Only what was typed is known then.
+	uncertain bool
+}
+
+func (ed *lineEditor) String() string {
+	return string(ed.line)
+}
+
+func (ed *lineEditor) reset() {
+	*ed = lineEditor{}
+}
+
+func (ed *lineEditor) insert(r rune) {
+	ed.line = append(ed.line, 0)
+	copy(ed.line[ed.cursor+1:], ed.line[ed.cursor:])
+	ed.line[ed.cursor] = r
+	ed.cursor++
+}
+
+// Removes the characters between the positions from and to of the line, and moves the cursor to
+// from
+func (ed *lineEditor) erase(from, to int) {
+	if from < 0 {
+		from = 0
+	}
+	if to > len(ed.line) {
+		to = len(ed.line)
+	}
+	if from >= to {
+		return
+	}
+	ed.line = append(ed.line[:from], ed.line[to:]...)
+	ed.cursor = from
+}
+
+// The start of the word before the cursor, as for Ctrl-W
+func (ed *lineEditor) wordStart() int {
+	i := ed.cursor
+	for i > 0 && ed.line[i-1] == ' ' {
+		i--
+	}
+	for i > 0 && ed.line[i-1] != ' ' {
+		i--
+	}
+	return i
+}
+
+// Whether the key is Enter, which runs the line. Enter ends the escape sequence or the character
+// being typed, if any.
+func (ed *lineEditor) isEnter(b byte) bool {
+	if (b != keyCR && b != keyLF) || ed.paste {
+		return false
+	}
+	ed.interrupt()
+	return true
+}
+
+// Drops the escape sequence or the character being typed, if any. The control keys end them,
+// whatever the shell then makes of them.
+func (ed *lineEditor) interrupt() {
+	if ed.escape {
+		ed.uncertain = true
+	}
+	ed.escape = false
+	ed.partial = nil
+}
+
+// Feeds one byte of input, but for Enter
+func (ed *lineEditor) feed(b byte) {
+	if b < 0x20 || (len(ed.partial) > 0 && !ed.escape && b < utf8.RuneSelf) {
+		ed.interrupt()
+	}
+	if ed.escape {
+		ed.partial = append(ed.partial, b)
+		ed.escapeSequence()
+		return
+	}
+	if len(ed.partial) > 0 || b >= utf8.RuneSelf {
+		ed.partial = append(ed.partial, b)
+		if utf8.FullRune(ed.partial) {
+			r, _ := utf8.DecodeRune(ed.partial)
+			ed.partial = nil
+			ed.insert(r)
+		}
+		return
+	}
+	if ed.paste && (b == keyCR || b == keyLF) {
+		ed.insert('\n')
+		return
+	}
+
+	switch b {
+	case keyEscape:
+		ed.escape = true
+		ed.partial = []byte{b}
+	case keyCtrlA:
+		ed.cursor = 0
+	case keyCtrlE:
+		ed.cursor = len(ed.line)
+	case keyCtrlB:
+		if ed.cursor > 0 {
+			ed.cursor--
+		}
+	case keyCtrlF:
+		if ed.cursor < len(ed.line) {
+			ed.cursor++
+		}
+	case keyBackspace, keyDelete:
+		ed.erase(ed.cursor-1, ed.cursor)
+	case keyCtrlD:
+		ed.erase(ed.cursor, ed.cursor+1)
+	case keyCtrlK:
+		ed.erase(ed.cursor, len(ed.line))
+	case keyCtrlU:
+		ed.erase(0, ed.cursor)
+	case keyCtrlW:
+		ed.erase(ed.wordStart(), ed.cursor)
+	case keyCtrlC:
+		ed.reset()
+	case keyTab, keyCtrlP, keyCtrlN, keyCtrlR, keyCtrlY:
+		ed.uncertain = true
+	default:
+		if b >= 0x20 {
+			ed.insert(rune(b))
+		}
+	}
+}
+
+// Handles the escape sequence read so far, once it's complete: CSI (ESC [ ... final byte), SS3
+// (ESC O x) or a key pressed with Alt (ESC x)
+func (ed *lineEditor) escapeSequence() {
+	seq := ed.partial
+	if len(seq) < 2 {
+		return
+	}
+	switch seq[1] {
+	case '[':
+		if last := seq[len(seq)-1]; len(seq) == 2 || last < 0x40 || last > 0x7e {
+			return
+		}
+	case 'O':
+		if len(seq) < 3 {
+			return
+		}
+	}
+	ed.escape = false
+	ed.partial = nil
+
+	switch string(seq[1:]) {
+	case "[200~":
+		ed.paste = true
+	case "[201~":
+		ed.paste = false
+	case "[C", "OC":
+		if ed.cursor < len(ed.line) {
+			ed.cursor++
+		}
+	case "[D", "OD":
+		if ed.cursor > 0 {
+			ed.cursor--
+		}
+	case "[H", "OH", "[1~", "[7~":
+		ed.cursor = 0
+	case "[F", "OF", "[4~", "[8~":
+		ed.cursor = len(ed.line)
+	case "[3~":
+		ed.erase(ed.cursor, ed.cursor+1)
+	default:
+		// E.g. the history with the arrows, or the word moves with Alt
+		if !ed.paste {
+			ed.uncertain = true
+		}
+	}
+}
+
+// Checks the input of a session against the rules, one line at a time
+type inputFilter struct {
+	rules []InputRule
+
+	lock   sync.Mutex
+	editor lineEditor
+	// The line waiting for Enter to be pressed again, if any
+	confirming *string
+	// Whether the line was held back by a CR, whose LF is not a second Enter
+	heldByCR bool
+}
+
+// What the typist is told about the lines matching a rule
+type inputEvent struct {
+	line string
+	rule *InputRule
+	// Whether the line of a confirm rule was run, rather than held back
+	confirmed bool
+	// Whether the line might not be exactly the one the shell has
+	uncertain bool
+}
+
+func (f *inputFilter) match(line string) *InputRule {
+	for i := range f.rules {
+		if f.rules[i].Pattern.MatchString(line) {
+			return &f.rules[i]
+		}
+	}
+	return nil
+}
+
+// Returns what to write to the PTY out of the input, and the lines which matched a rule
+func (f *inputFilter) filter(data []byte) ([]byte, []inputEvent) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	out := make([]byte, 0, len(data))
+	var events []inputEvent
+	// Whether a line was held back by this input: it's only confirmed by a later key press
+	held := false
+	for _, b := range data {
+		heldByCR := f.heldByCR
+		f.heldByCR = false
+		if b == keyLF && heldByCR {
+			continue
+		}
+		if !f.editor.isEnter(b) {
+			f.confirming = nil
+			f.editor.feed(b)
+			out = append(out, b)
+			continue
+		}
+
+		line := f.editor.String()
+		rule := f.match(line)
+		if rule == nil {
+			out = append(out, b)
+			f.editor.reset()
+			continue
+		}
+		event := inputEvent{line: line, rule: rule, uncertain: f.editor.uncertain}
+		switch rule.Action {
+		case InputBlock:
+			out = append(out, discardLine...)
+			f.editor.reset()
+		case InputConfirm:
+			if f.confirming != nil && *f.confirming == line && held {
+				// Sent along with the line, e.g. pasted: not a confirmation
+				continue
+			}
+			if f.confirming != nil && *f.confirming == line {
+				out = append(out, b)
+				f.editor.reset()
+				f.confirming = nil
+				event.confirmed = true
+			} else {
+				// Held back until Enter is pressed again, with nothing else in between
+				f.confirming = &line
+				f.heldByCR = b == keyCR
+				held = true
+			}
+		default:
+			out = append(out, b)
+			f.editor.reset()
+		}
+		events = append(events, event)
+	}
+	return out, events
+}
+
+// Sets the rules the input of the drivers is checked against, in order: a line gets the action
+// of the first rule it matches. No input is checked without rules.
+func (session *TTYShareSession) SetInputRules(rules []InputRule) {
+	var filter *inputFilter
+	if len(rules) > 0 {
+		filter = &inputFilter{rules: rules}
+	}
+	session.mainRWLock.Lock()
+	session.inputFilter = filter
+	session.mainRWLock.Unlock()
+}
+
+// Forwards the input of the driver to the PTY, through the input rules of the session
+func (session *TTYShareSession) input(rcv *participant, data []byte) {
+	session.mainRWLock.RLock()
+	filter := session.inputFilter
+	session.mainRWLock.RUnlock()
+	if filter == nil {
+		session.ptyHandler.Write(data)
+		return
+	}
+
+	out, events := filter.filter(data)
+	if len(out) > 0 {
+		session.ptyHandler.Write(out)
+	}
+	for _, event := range events {
+		event.line = session.redactLine(event.line)
+		auditEvent := rcv.event(audit.InputRuleMatched)
+		auditEvent.Line = event.line
+		auditEvent.Action = string(event.rule.Action)
+		if event.confirmed {
+			auditEvent.Action = "confirmed"
+		}
+		session.emit(auditEvent)
+		if event.confirmed {
+			log.Printf("Input of %s confirmed by its typist: %q", rcv.name(), event.line)
+			continue
+		}
+		known := ""
+		if event.uncertain {
+			known = " (as far as it was typed)"
+		}
+		log.Printf("Input of %s matched a %s rule: %q%s", rcv.name(), event.rule.Action, event.line, known)
+		switch event.rule.Action {
+		case InputBlock:
+			rcv.proto.Notice("Blocked: " + event.rule.describe() + ". The line was discarded.")
+		case InputWarn:
+			rcv.proto.Notice("Warning: " + event.rule.describe() + ".")
+		case InputConfirm:
+			rcv.proto.Notice("Confirm: " + event.rule.describe() + ". Press Enter again to run it anyway.")
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package tty
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestLineEditor(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		line      string
+		uncertain bool
+	}{
+		{"typed", "ls -l", "ls -l", false},
+		{"backspace", "lss\x7f -l", "ls -l", false},
+		{"cursor moves", "ls\x1b[D\x1b[Dx\x1b[C\x1b[Cy", "xlsy", false},
+		{"home and end", "b\x1b[Ha\x1bOFc", "abc", false},
+		{"delete", "abc\x01\x1b[3~", "bc", false},
+		{"kill the line", "rm -rf /\x15ls", "ls", false},
+		{"erase a word", "echo rm -rf\x17x", "echo rm x", false},
+		{"UTF-8", "echo h\xc3\xa9", "echo hé", false},
+		{"UTF-8 interrupted", "echo \xc3a", "echo a", false},
+		{"history", "\x1b[A", "", true},
+		{"completion", "ec\t", "ec", true},
+		{"escape interrupted", "echo\x1b[\x01x", "xecho", true},
+		{"escape then typed", "echo\x1b[1;5Dx", "echox", true},
+		{"paste", "\x1b[200~echo a\recho b\x1b[201~", "echo a\necho b", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ed lineEditor
+			for _, b := range []byte(test.input) {
+				ed.feed(b)
+			}
+			if got := ed.String(); got != test.line {
+				t.Errorf("line = %q, want %q", got, test.line)
+			}
+			if ed.uncertain != test.uncertain {
+				t.Errorf("uncertain = %v, want %v", ed.uncertain, test.uncertain)
+			}
+		})
+	}
+}
+
+func TestInputFilter(t *testing.T) {
+	rules := []InputRule{
+		{Pattern: regexp.MustCompile(`rm -rf`), Action: InputBlock},
+		{Pattern: regexp.MustCompile(`(?i)drop table`), Action: InputConfirm},
+		{Pattern: regexp.MustCompile(`^sudo`), Action: InputWarn},
+	}
+	blocked := string(discardLine)
+	tests := []struct {
+		name string
+		// Written one after the other
+		inputs []string
+		out    string
+		// The actions of the events, in order
+		actions []string
+	}{
+		{"allowed", []string{"ls\r"}, "ls\r", nil},
+		{"blocked", []string{"rm -rf /\r"}, "rm -rf /" + blocked, []string{"block"}},
+		{"blocked with LF", []string{"rm -rf /\n"}, "rm -rf /" + blocked, []string{"block"}},
+		{"blocked after editing", []string{"rm -rf /\x7f\x7f\r"}, "rm -rf /\x7f\x7f" + blocked, []string{"block"}},
+		{"unblocked by editing", []string{"rm -rf /\x01\x04\x04\r"}, "rm -rf /\x01\x04\x04\r", nil},
+		{"warned", []string{"sudo ls\r"}, "sudo ls\r", []string{"warn"}},
+		{"Enter in an escape sequence", []string{"rm -rf /\x1b[\r\r"}, "rm -rf /\x1b[" + blocked + "\r", []string{"block"}},
+		{"Enter after an interrupted escape", []string{"rm -rf /\x1b[\x01x\x05\r"}, "rm -rf /\x1b[\x01x\x05" + blocked, []string{"block"}},
+		{"Enter in a character", []string{"rm -rf /\xc3\r"}, "rm -rf /\xc3" + blocked, []string{"block"}},
+		{"Enter in a paste", []string{"\x1b[200~rm -rf /\r\x1b[201~"}, "\x1b[200~rm -rf /\r\x1b[201~", nil},
+		{"paste blocked", []string{"\x1b[200~rm -rf /\x1b[201~\r"}, "\x1b[200~rm -rf /\x1b[201~" + blocked, []string{"block"}},
+		{"held", []string{"drop table x\r"}, "drop table x", []string{"confirm"}},
+		{"confirmed", []string{"drop table x\r", "\r"}, "drop table x\r", []string{"confirm", "confirmed"}},
+		{"CRLF held", []string{"drop table x\r\n"}, "drop table x", []string{"confirm"}},
+		{"CRLF confirmed", []string{"drop table x\r\n", "\r\n"}, "drop table x\r\n", []string{"confirm", "confirmed"}},
+		{"CR and LF split", []string{"drop table x\r", "\n"}, "drop table x", []string{"confirm"}},
+		{"confirmed along", []string{"drop table x\r\r"}, "drop table x", []string{"confirm"}},
+		{"not confirmed after typing", []string{"drop table x\r", "y\x7f", "\r"}, "drop table xy\x7f", []string{"confirm", "confirm"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &inputFilter{rules: rules}
+			var out []byte
+			var actions []string
+			for _, input := range test.inputs {
+				written, events := f.filter([]byte(input))
+				out = append(out, written...)
+				for _, event := range events {
+					action := string(event.rule.Action)
+					if event.confirmed {
+						action = "confirmed"
+					}
+					actions = append(actions, action)
+				}
+			}
+			if string(out) != test.out {
+				t.Errorf("out = %q, want %q", out, test.out)
+			}
+			if len(actions) != len(test.actions) {
+				t.Fatalf("actions = %v, want %v", actions, test.actions)
+			}
+			for i := range actions {
+				if actions[i] != test.actions[i] {
+					t.Errorf("actions = %v, want %v", actions, test.actions)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package tty
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gg-tools/remotecommand/internal/redact"
+)
+
+// How long the output has to be idle for the complete lines held back from the viewers to be sent
+const redactionFlushLinesDelay = 40 * time.Millisecond
+
+// How long the output has to be idle for all of it held back from the viewers to be sent, e.g. a
+// prompt, or what the driver is typing. A secret written slower than that can be seen partially,
+// but for a block (e.g. a PEM key): what can be the beginning of its marker waits for more output.
+const redactionFlushDelay = 300 * time.Millisecond
+
+// Masks the secrets in the output sent to the viewers. The drivers get the output as it is: they
+// can type whatever they want anyway.
+type outputRedaction struct {
+	redactor *redact.Redactor
+
+	// Held across the writes, so that the output of the stream is sent in order
+	lock   sync.Mutex
+	stream *redact.Stream
+	timer  *time.Timer
+	// Whether the timer flushes the complete lines only
+	flushLines bool
+}
+
+// Masks the secrets in the output sent to the viewers, in the input lines written to the audit
+// events and to the log. Nothing is masked with a nil redactor.
+func (session *TTYShareSession) SetRedactor(redactor *redact.Redactor) {
+	var redaction *outputRedaction
+	if redactor != nil {
+		redaction = &outputRedaction{redactor: redactor, stream: redactor.Stream()}
+	}
+	session.mainRWLock.Lock()
+	session.redaction = redaction
+	session.mainRWLock.Unlock()
+}
+
+func (session *TTYShareSession) redactionOf() *outputRedaction {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+	return session.redaction
+}
+
+// Masks the secrets in a line of input, before it's persisted
+func (session *TTYShareSession) redactLine(line string) string {
+	if redaction := session.redactionOf(); redaction != nil {
+		return redaction.redactor.String(line)
+	}
+	return line
+}
+
+// Sends the output to the participants: the viewers get redacted, which can be empty while the
+// end of the output is held back
+func (session *TTYShareSession) sendOutput(data, redacted []byte) {
+	session.forEachReceiverLock(func(rcv *participant) bool {
+		out := data
+		if rcv.role == RoleViewer {
+			out = redacted
+		}
+		if len(out) == 0 {
+			return true
+		}
+		if _, err := rcv.proto.Write(out); err == nil {
+			atomic.AddInt64(&rcv.bytesOut, int64(len(out)))
+		}
+		return true
+	})
+}
+
+func (session *TTYShareSession) writeRedacted(redaction *outputRedaction, data []byte) {
+	redaction.lock.Lock()
+	defer redaction.lock.Unlock()
+	session.sendOutput(data, redaction.stream.Write(data))
+	if !redaction.stream.Pending() {
+		return
+	}
+	redaction.flushLines = true
+	if redaction.timer == nil {
+		redaction.timer = time.AfterFunc(redactionFlushLinesDelay, func() {
+			session.flushRedacted()
+		})
+	} else {
+		redaction.timer.Reset(redactionFlushLinesDelay)
+	}
+}
+
+// Sends all the output held back from the viewers, once the command exited
+func (session *TTYShareSession) endRedacted() {
+	redaction := session.redactionOf()
+	if redaction == nil {
+		return
+	}
+	redaction.lock.Lock()
+	defer redaction.lock.Unlock()
+	if redaction.timer != nil {
+		redaction.timer.Stop()
+	}
+	if out := redaction.stream.End(); len(out) > 0 {
+		session.sendOutput(nil, out)
+	}
+}
+
+// Sends the output held back from the viewers: the complete lines only for a start, then all of it
+func (session *TTYShareSession) flushRedacted() {
+	redaction := session.redactionOf()
+	if redaction == nil {
+		return
+	}
+	redaction.lock.Lock()
+	defer redaction.lock.Unlock()
+	var out []byte
+	if !redaction.flushLines {
+		out = redaction.stream.Flush()
+	} else {
+		out = redaction.stream.FlushLines()
+		// The rest of it is sent if the output stays idle
+		redaction.flushLines = false
+		if redaction.stream.Pending() {
+			redaction.timer.Reset(redactionFlushDelay - redactionFlushLinesDelay)
+		}
+	}
+	if len(out) > 0 {
+		session.sendOutput(nil, out)
+	}
+}
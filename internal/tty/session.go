@@ -2,23 +2,114 @@ package tty
 
 import (
 	"container/list"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gg-tools/remotecommand/internal/audit"
 	"github.com/gorilla/websocket"
 	"log"
 )
 
+var (
+	ErrSessionClosed = errors.New("session closed")
+	ErrSessionFull   = errors.New("session full")
+	ErrNoOwner       = errors.New("no owner of the session is connected to let the others in")
+	// The participant left, or was turned away, before being let in
+	ErrNotAdmitted = errors.New("not let in the session")
+)
+
 type PTYHandler interface {
 	Write(data []byte) (int, error)
+	SetWinSize(rows, cols int)
 	Refresh()
 }
 
+// What a participant is allowed to do in a session
+type Role string
+
+const (
+	// Can only watch: its input and resize requests are dropped
+	RoleViewer Role = "viewer"
+	// Can type into the session
+	RoleDriver Role = "driver"
+)
+
+func ParseRole(role string) (Role, error) {
+	switch Role(role) {
+	case RoleViewer, RoleDriver:
+		return Role(role), nil
+	}
+	return "", fmt.Errorf("unknown role: %s", role)
+}
+
+// Describes who joins a session
+type JoinOptions struct {
+	// Who the connection was authenticated as, if any
+	Identity string
+	Role     Role
+	// The owners of a session can take its control back at any time, and let in the others
+	Owner bool
+	// Whether an owner has to let the connection in. The owners are always let in right away.
+	RequireApproval bool
+}
+
+// One of the connections attached to a session
+type participant struct {
+	// Received from, and sent to, the connection. Used with atomic. First, to be 64-bit aligned.
+	bytesIn  int64
+	bytesOut int64
+
+	id         string
+	proto      *TTYProtocolWSLocked
+	ws         *websocket.Conn
+	identity   string
+	role       Role
+	owner      bool
+	remoteAddr string
+	joinedAt   time.Time
+
+	// The element of the participant in the connections of the session, nil while it waits to be
+	// let in. Guarded by the mainRWLock of the session.
+	el            *list.Element
+	approvalTimer *time.Timer
+
+	warnedNotDriving bool // guarded by the controlLock of the session
+}
+
+// Describes a participant, as reported to the outside of the session
+type ParticipantInfo struct {
+	ID         string    `json:"id"`
+	Identity   string    `json:"identity,omitempty"`
+	Role       Role      `json:"role"`
+	Owner      bool      `json:"owner"`
+	Driving    bool      `json:"driving"`
+	RemoteAddr string    `json:"remote_addr"`
+	JoinedAt   time.Time `json:"joined_at"`
+}
+
 type TTYShareSession struct {
+	lastActivity        int64 // unix nanoseconds, used with atomic. First, to be 64-bit aligned
 	mainRWLock          sync.RWMutex
 	ttyProtoConnections *list.List
 	isAlive             bool
 	lastWindowSizeMsg   MsgTTYWinSize
 	ptyHandler          PTYHandler
+	onExtend            func()
+	participantsJoined  int
+	pending             []*participant   // waiting to be let in, in the order they asked
+	inputFilter         *inputFilter     // nil if the input isn't checked
+	redaction           *outputRedaction // nil if the output isn't redacted
+	audit               *audit.Emitter
+	maxParticipants     int    // 0 means no limit
+	id                  string // as known to the audit events
+
+	// Who is in control of the session. Taken before mainRWLock when both are needed.
+	controlLock sync.Mutex
+	driver      *participant
+	requester   *participant // the last participant who asked for the control
 }
 
 func copyList(l *list.List) *list.List {
@@ -33,7 +124,9 @@ func NewTTYShareSession(ptyHandler PTYHandler) *TTYShareSession {
 
 	ttyShareSession := &TTYShareSession{
 		ttyProtoConnections: list.New(),
+		isAlive:             true,
 		ptyHandler:          ptyHandler,
+		lastActivity:        time.Now().UnixNano(),
 	}
 
 	return ttyShareSession
@@ -44,33 +137,179 @@ func (session *TTYShareSession) WindowSize(cols, rows int) error {
 	session.lastWindowSizeMsg = MsgTTYWinSize{Cols: cols, Rows: rows}
 	session.mainRWLock.Unlock()
 
-	session.forEachReceiverLock(func(rcvConn *TTYProtocolWSLocked) bool {
-		rcvConn.SetWinSize(cols, rows)
+	session.forEachReceiverLock(func(rcv *participant) bool {
+		rcv.proto.SetWinSize(cols, rows)
 		return true
 	})
 	return nil
 }
 
 func (session *TTYShareSession) Write(data []byte) (int, error) {
-	session.forEachReceiverLock(func(rcvConn *TTYProtocolWSLocked) bool {
-		rcvConn.Write(data)
+	session.touch()
+	if redaction := session.redactionOf(); redaction != nil {
+		session.writeRedacted(redaction, data)
+		return len(data), nil
+	}
+	session.sendOutput(data, data)
+	return len(data), nil
+}
+
+// Sets the callback called when one of the participants asks for the session to be extended
+func (session *TTYShareSession) SetOnExtend(cb func()) {
+	session.mainRWLock.Lock()
+	session.onExtend = cb
+	session.mainRWLock.Unlock()
+}
+
+// The last time there was some input or output in the session
+func (session *TTYShareSession) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&session.lastActivity))
+}
+
+func (session *TTYShareSession) touch() {
+	atomic.StoreInt64(&session.lastActivity, time.Now().UnixNano())
+}
+
+func (session *TTYShareSession) extend() {
+	session.mainRWLock.RLock()
+	onExtend := session.onExtend
+	session.mainRWLock.RUnlock()
+	if onExtend != nil {
+		onExtend()
+	}
+}
+
+// Limits the number of the connections attached to the session, including the ones waiting to be
+// let in. The owners can always join. 0 means no limit.
+func (session *TTYShareSession) SetMaxParticipants(max int) {
+	session.mainRWLock.Lock()
+	session.maxParticipants = max
+	session.mainRWLock.Unlock()
+}
+
+// Whether the session can't take any more participants, but its owners
+func (session *TTYShareSession) Full() bool {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+	return session.fullLocked()
+}
+
+func (session *TTYShareSession) fullLocked() bool {
+	return session.maxParticipants > 0 && session.ttyProtoConnections.Len()+len(session.pending) >= session.maxParticipants
+}
+
+// Number of the connections currently attached to the session
+func (session *TTYShareSession) ParticipantCount() int {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+	return session.ttyProtoConnections.Len()
+}
+
+// Resizes the PTY as requested by one of the participants, and lets all of them know about the
+// new size
+func (session *TTYShareSession) resize(rcv *participant, cols, rows int) {
+	if cols <= 0 || rows <= 0 {
+		return
+	}
+	lastCols, lastRows := session.LastWindowSize()
+	session.ptyHandler.SetWinSize(rows, cols)
+	session.WindowSize(cols, rows)
+	if cols != lastCols || rows != lastRows {
+		event := rcv.event(audit.Resized)
+		event.Cols, event.Rows = cols, rows
+		session.emit(event)
+	}
+}
+
+// The participants currently attached to the session
+func (session *TTYShareSession) Participants() []ParticipantInfo {
+	infos := []ParticipantInfo{}
+	session.forEachReceiverLock(func(rcv *participant) bool {
+		infos = append(infos, ParticipantInfo{
+			ID:         rcv.id,
+			Identity:   rcv.identity,
+			Role:       rcv.role,
+			Owner:      rcv.owner,
+			Driving:    session.isDriving(rcv),
+			RemoteAddr: rcv.remoteAddr,
+			JoinedAt:   rcv.joinedAt,
+		})
 		return true
 	})
-	return len(data), nil
+	return infos
+}
+
+// The last window size that was broadcast to the participants
+func (session *TTYShareSession) LastWindowSize() (cols, rows int) {
+	session.mainRWLock.RLock()
+	defer session.mainRWLock.RUnlock()
+	return session.lastWindowSizeMsg.Cols, session.lastWindowSizeMsg.Rows
+}
+
+// Sends a notice to all the participants
+func (session *TTYShareSession) Notice(text string) {
+	session.forEachReceiverLock(func(rcv *participant) bool {
+		rcv.proto.Notice(text)
+		return true
+	})
+}
+
+// Lets all the participants know that the command of the session has exited
+func (session *TTYShareSession) Exit(code int, signal string) {
+	session.endRedacted()
+	session.forEachReceiverLock(func(rcv *participant) bool {
+		rcv.proto.Exit(code, signal)
+		return true
+	})
+}
+
+// Marks the session as finished and closes the connections of all the participants. Their
+// HandleWSConnection calls will return once their reading loops notice the closed connection.
+func (session *TTYShareSession) Close() {
+	session.mainRWLock.Lock()
+	session.isAlive = false
+	session.mainRWLock.Unlock()
+
+	session.forEachReceiverLock(func(rcv *participant) bool {
+		rcv.ws.Close()
+		return true
+	})
+	session.mainRWLock.RLock()
+	for _, rcv := range session.pending {
+		rcv.ws.Close()
+	}
+	session.mainRWLock.RUnlock()
+}
+
+// Starts serving a participant let in the session
+func (session *TTYShareSession) welcome(rcv *participant) {
+	log.Printf("New WS connection (%s %s, %s), %d participant(s). Serving ..", rcv.identity, rcv.remoteAddr, rcv.role, session.ParticipantCount())
+	session.emit(rcv.event(audit.ParticipantJoined))
+
+	// Let the client know what it can do, and send it the initial size of the window
+	cols, rows := session.LastWindowSize()
+	rcv.proto.SetRole(rcv.role)
+	rcv.proto.SetWinSize(cols, rows)
+	session.controlJoin(rcv)
+	if rcv.owner {
+		if requests := session.joinRequests(); len(requests) > 0 {
+			rcv.proto.SetJoinRequests(requests)
+		}
+	}
 }
 
 // Runs the callback cb for each of the receivers in the list of the receivers, as it was when
 // this function was called. Note that there might be receivers which might have lost
 // the connection since this function was called.
 // Return false in the callback to not continue for the rest of the receivers
-func (session *TTYShareSession) forEachReceiverLock(cb func(rcvConn *TTYProtocolWSLocked) bool) {
+func (session *TTYShareSession) forEachReceiverLock(cb func(rcv *participant) bool) {
 	session.mainRWLock.RLock()
 	// TODO: Maybe find a better way?
 	rcvsCopy := copyList(session.ttyProtoConnections)
 	session.mainRWLock.RUnlock()
 
 	for receiverE := rcvsCopy.Front(); receiverE != nil; receiverE = receiverE.Next() {
-		receiver := receiverE.Value.(*TTYProtocolWSLocked)
+		receiver := receiverE.Value.(*participant)
 		if !cb(receiver) {
 			break
 		}
@@ -78,30 +317,101 @@ func (session *TTYShareSession) forEachReceiverLock(cb func(rcvConn *TTYProtocol
 }
 
 // Will run on the TTYReceiver connection go routine (e.g.: on the websockets connection routine)
-// When HandleWSConnection will exit, the connection to the TTYReceiver will be closed
-func (session *TTYShareSession) HandleWSConnection(wsConn *websocket.Conn) {
-	protoConn := NewTTYProtocolWSLocked(wsConn)
+// When HandleWSConnection will exit, the connection to the TTYReceiver will be closed.
+// Any number of connections can be handled at the same time: they all get the output of the
+// session, and the input of the participant in control is forwarded to the PTY.
+func (session *TTYShareSession) HandleWSConnection(wsConn *websocket.Conn, opts JoinOptions) error {
+	if opts.Role == "" {
+		opts.Role = RoleDriver
+	}
+	rcv := &participant{
+		proto:      NewTTYProtocolWSLocked(wsConn),
+		ws:         wsConn,
+		identity:   opts.Identity,
+		role:       opts.Role,
+		owner:      opts.Owner,
+		remoteAddr: wsConn.RemoteAddr().String(),
+		joinedAt:   time.Now(),
+	}
 
 	session.mainRWLock.Lock()
-	rcvHandleEl := session.ttyProtoConnections.PushBack(protoConn)
-	winSize := session.lastWindowSizeMsg
+	if !session.isAlive {
+		session.mainRWLock.Unlock()
+		wsConn.Close()
+		return ErrSessionClosed
+	}
+	if !opts.Owner && session.fullLocked() {
+		session.mainRWLock.Unlock()
+		rcv.proto.Notice("The session is full.")
+		wsConn.Close()
+		return ErrSessionFull
+	}
+	session.participantsJoined++
+	rcv.id = fmt.Sprintf("p%d", session.participantsJoined)
+	pending := opts.RequireApproval && !opts.Owner
+	if pending && !session.ownerConnectedLocked() {
+		session.mainRWLock.Unlock()
+		session.deny(rcv, noOwnerReason)
+		return ErrNoOwner
+	}
+	if pending {
+		rcv.approvalTimer = time.AfterFunc(joinApprovalTimeout, func() {
+			session.decideJoin(rcv.id, false, "Nobody let you in in time.")
+		})
+		session.pending = append(session.pending, rcv)
+	} else {
+		rcv.el = session.ttyProtoConnections.PushBack(rcv)
+	}
 	session.mainRWLock.Unlock()
 
-	log.Printf("New WS connection (%s). Serving ..", wsConn.RemoteAddr().String())
-
-	// Sending the initial size of the window, if we have one
-	protoConn.SetWinSize(winSize.Cols, winSize.Rows)
+	if pending {
+		session.waitApproval(rcv)
+	} else {
+		session.welcome(rcv)
+	}
 
 	// Wait until the TTYReceiver will close the connection on its end
 	for {
-		err := protoConn.ReadAndHandle(
-			func(data []byte) {
-				session.ptyHandler.Write(data)
+		err := rcv.proto.ReadAndHandle(MsgHandlers{
+			OnWrite: func(data []byte) {
+				atomic.AddInt64(&rcv.bytesIn, int64(len(data)))
+				if !session.admitted(rcv) {
+					return
+				}
+				if !session.isDriving(rcv) {
+					if rcv.role == RoleDriver {
+						session.warnNotDriving(rcv)
+					}
+					return
+				}
+				session.touch()
+				session.input(rcv, data)
+			},
+			OnWinSize: func(cols, rows int) {
+				if !session.admitted(rcv) || !session.isDriving(rcv) {
+					return
+				}
+				session.resize(rcv, cols, rows)
+			},
+			OnControl: func(action, target string) {
+				if !session.admitted(rcv) {
+					return
+				}
+				session.handleControl(rcv, action, target)
 			},
-			func(cols, rows int) {
-				session.ptyHandler.Refresh()
+			OnJoinDecision: func(id string, approve bool) {
+				if !session.admitted(rcv) {
+					return
+				}
+				session.handleJoinDecision(rcv, id, approve)
 			},
-		)
+			OnExtend: func() {
+				if rcv.role != RoleDriver || !session.admitted(rcv) {
+					return
+				}
+				session.extend()
+			},
+		})
 
 		if err != nil {
 			log.Printf("Finished the WS reading loop: %s", err.Error())
@@ -111,9 +421,33 @@ func (session *TTYShareSession) HandleWSConnection(wsConn *websocket.Conn) {
 
 	// Remove the recevier from the list of the receiver of this session, so we need to write-lock
 	session.mainRWLock.Lock()
-	session.ttyProtoConnections.Remove(rcvHandleEl)
+	admitted := rcv.el != nil
+	if admitted {
+		session.ttyProtoConnections.Remove(rcv.el)
+	}
+	wasPending := false
+	for i, other := range session.pending {
+		if other == rcv {
+			session.pending = append(session.pending[:i], session.pending[i+1:]...)
+			wasPending = true
+			break
+		}
+	}
 	session.mainRWLock.Unlock()
+	if wasPending {
+		rcv.approvalTimer.Stop()
+		session.announceJoinRequests()
+	}
+	session.controlLeave(rcv)
+	session.emit(rcv.leftEvent())
+	if rcv.owner {
+		session.denyPendingWithoutOwner()
+	}
 
 	wsConn.Close()
-	log.Println("Closed receiver connection")
+	log.Printf("Closed receiver connection (%s)", rcv.remoteAddr)
+	if !admitted {
+		return ErrNotAdmitted
+	}
+	return nil
 }
@@ -0,0 +1,122 @@
+package tty
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type nopPTY struct{}
+
+func (nopPTY) Write(data []byte) (int, error) { return len(data), nil }
+func (nopPTY) SetWinSize(rows, cols int)      {}
+func (nopPTY) Refresh()                       {}
+
+// Serves the session over WS: the connections with ?owner join as its owner, the others have to
+// be let in. What HandleWSConnection returns is sent to results.
+func serveSession(t *testing.T, session *TTYShareSession, results chan<- error) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		owner := r.URL.Query().Get("owner") != ""
+		results <- session.HandleWSConnection(conn, JoinOptions{
+			Identity:        r.URL.Query().Get("name"),
+			Owner:           owner,
+			RequireApproval: true,
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dial(t *testing.T, server *httptest.Server, query string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitResult(t *testing.T, results <-chan error) error {
+	select {
+	case err := <-results:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleWSConnection did not return")
+		return nil
+	}
+}
+
+// The participants which were never let in are told apart, e.g. so that the share link they used
+// can be used again
+func TestHandleWSConnectionNotAdmitted(t *testing.T) {
+	tests := []struct {
+		name string
+		// What happens to the participant once it waits to be let in
+		decide func(t *testing.T, session *TTYShareSession, conn *websocket.Conn)
+		err    error
+	}{
+		{"denied", func(t *testing.T, session *TTYShareSession, conn *websocket.Conn) {
+			session.decideJoin(session.joinRequests()[0].ID, false, "no")
+		}, ErrNotAdmitted},
+		{"left while waiting", func(t *testing.T, session *TTYShareSession, conn *websocket.Conn) {
+			conn.Close()
+		}, ErrNotAdmitted},
+		{"let in, then left", func(t *testing.T, session *TTYShareSession, conn *websocket.Conn) {
+			session.decideJoin(session.joinRequests()[0].ID, true, "")
+			waitFor(t, "the participant to be let in", func() bool { return session.ParticipantCount() == 2 })
+			conn.Close()
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := NewTTYShareSession(nopPTY{})
+			results := make(chan error, 2)
+			server := serveSession(t, session, results)
+
+			owner := dial(t, server, "owner=1&name=alice")
+			defer owner.Close()
+			waitFor(t, "the owner to join", func() bool { return session.ParticipantCount() == 1 })
+
+			conn := dial(t, server, "name=bob")
+			defer conn.Close()
+			waitFor(t, "the join request", func() bool { return len(session.joinRequests()) == 1 })
+			test.decide(t, session, conn)
+			conn.Close()
+
+			if err := waitResult(t, results); err != test.err {
+				t.Errorf("HandleWSConnection = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestHandleWSConnectionNoOwner(t *testing.T) {
+	session := NewTTYShareSession(nopPTY{})
+	results := make(chan error, 1)
+	server := serveSession(t, session, results)
+
+	conn := dial(t, server, "name=bob")
+	defer conn.Close()
+	if err := waitResult(t, results); err != ErrNoOwner {
+		t.Errorf("HandleWSConnection = %v, want %v", err, ErrNoOwner)
+	}
+}
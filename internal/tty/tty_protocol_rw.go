@@ -11,6 +11,37 @@ import (
 const (
 	MsgIDWrite   = "Write"
 	MsgIDWinSize = "WinSize"
+	MsgIDExit    = "Exit"
+	MsgIDNotice  = "Notice"
+	MsgIDExtend  = "Extend"
+	MsgIDRole    = "Role"
+	MsgIDControl = "Control"
+	MsgIDDriver  = "Driver"
+
+	MsgIDJoinRequests = "JoinRequests"
+	MsgIDJoinDecision = "JoinDecision"
+	MsgIDJoinStatus   = "JoinStatus"
+)
+
+// The actions of the Control messages
+const (
+	// Ask for the control of the session. Granted right away if nobody is driving.
+	ControlRequest = "request"
+	// Give up the control of the session, to the pending requester if any
+	ControlRelease = "release"
+	// Give the control of the session to Target, or to the pending requester if Target is empty.
+	// Only the driver and the owners of the session can do that.
+	ControlGrant = "grant"
+	// Take the control of the session back. Only the owners of the session can do that.
+	ControlRevoke = "revoke"
+)
+
+// The statuses of the JoinStatus messages
+const (
+	// Waiting for an owner of the session to let the connection in
+	JoinPending  = "pending"
+	JoinApproved = "approved"
+	JoinDenied   = "denied"
 )
 
 // Message used to encapsulate the rest of the bessages bellow
@@ -29,8 +60,94 @@ type MsgTTYWinSize struct {
 	Rows int
 }
 
+// Sent to the clients when the command of the session has exited. Signal is set if the command
+// was terminated by a signal, in which case Code is 128 + the signal number, like in shells.
+type MsgTTYExit struct {
+	Code   int
+	Signal string
+}
+
+// A message from the server, to be shown to the user (e.g.: the server is shutting down)
+type MsgTTYNotice struct {
+	Text string
+}
+
+// Sent by a client to ask for its session to be extended, before it reaches its max lifetime
+type MsgTTYExtend struct {
+}
+
+// Sent to a client when it joins a session, to let it know what it's allowed to do
+type MsgTTYRole struct {
+	Role Role
+}
+
+// Sent by a client to ask for, or hand over, the control of the session. Target is the ID of a
+// participant.
+type MsgTTYControl struct {
+	Action string
+	Target string
+}
+
+// Sent to the clients when the participant in control of the session changes. Driver is empty
+// when nobody is driving.
+type MsgTTYDriver struct {
+	Driver string
+	You    bool
+}
+
+// A connection waiting to be let in a session
+type JoinRequest struct {
+	ID   string
+	Name string
+	Role Role
+}
+
+// Sent to the owners of a session each time the list of the connections waiting to join it
+// changes. Requests is empty once they were all decided.
+type MsgTTYJoinRequests struct {
+	Requests []JoinRequest
+}
+
+// Sent by an owner to let the connection with the ID in the session, or to turn it away
+type MsgTTYJoinDecision struct {
+	ID      string
+	Approve bool
+}
+
+// Sent to a connection waiting to join a session, when it starts waiting and once it's decided
+type MsgTTYJoinStatus struct {
+	Status string
+	Reason string
+}
+
 type OnMsgWrite func(data []byte)
 type OnMsgWinSize func(cols, rows int)
+type OnMsgExit func(code int, signal string)
+type OnMsgNotice func(text string)
+type OnMsgExtend func()
+type OnMsgRole func(role Role)
+type OnMsgControl func(action, target string)
+type OnMsgDriver func(driver string, you bool)
+type OnMsgJoinRequests func(requests []JoinRequest)
+type OnMsgJoinDecision func(id string, approve bool)
+type OnMsgJoinStatus func(status, reason string)
+
+// The callbacks ReadAndHandle calls for each type of message. The messages without a callback
+// are ignored.
+type MsgHandlers struct {
+	OnWrite   OnMsgWrite
+	OnWinSize OnMsgWinSize
+	OnExit    OnMsgExit
+	OnNotice  OnMsgNotice
+	OnExtend  OnMsgExtend
+	OnRole    OnMsgRole
+	OnControl OnMsgControl
+	OnDriver  OnMsgDriver
+
+	OnJoinRequests OnMsgJoinRequests
+	OnJoinDecision OnMsgJoinDecision
+	OnJoinStatus   OnMsgJoinStatus
+}
 
 type TTYProtocolWSLocked struct {
 	ws   *websocket.Conn
@@ -46,29 +163,41 @@ func NewTTYProtocolWSLocked(ws *websocket.Conn) *TTYProtocolWSLocked {
 func marshalMsg(aMessage interface{}) (_ []byte, err error) {
 	var msg MsgWrapper
 
-	if writeMsg, ok := aMessage.(MsgTTYWrite); ok {
+	switch aMessage.(type) {
+	case MsgTTYWrite:
 		msg.Type = MsgIDWrite
-		msg.Data, err = json.Marshal(writeMsg)
-		//fmt.Printf("Sent write message %s\n", string(writeMsg.Data))
-		if err != nil {
-			return
-		}
-		return json.Marshal(msg)
-	}
-
-	if winChangedMsg, ok := aMessage.(MsgTTYWinSize); ok {
+	case MsgTTYWinSize:
 		msg.Type = MsgIDWinSize
-		msg.Data, err = json.Marshal(winChangedMsg)
-		if err != nil {
-			return
-		}
-		return json.Marshal(msg)
+	case MsgTTYExit:
+		msg.Type = MsgIDExit
+	case MsgTTYNotice:
+		msg.Type = MsgIDNotice
+	case MsgTTYExtend:
+		msg.Type = MsgIDExtend
+	case MsgTTYRole:
+		msg.Type = MsgIDRole
+	case MsgTTYControl:
+		msg.Type = MsgIDControl
+	case MsgTTYDriver:
+		msg.Type = MsgIDDriver
+	case MsgTTYJoinRequests:
+		msg.Type = MsgIDJoinRequests
+	case MsgTTYJoinDecision:
+		msg.Type = MsgIDJoinDecision
+	case MsgTTYJoinStatus:
+		msg.Type = MsgIDJoinStatus
+	default:
+		return nil, nil
 	}
 
-	return nil, nil
+	msg.Data, err = json.Marshal(aMessage)
+	if err != nil {
+		return
+	}
+	return json.Marshal(msg)
 }
 
-func (handler *TTYProtocolWSLocked) ReadAndHandle(onWrite OnMsgWrite, onWinSize OnMsgWinSize) (err error) {
+func (handler *TTYProtocolWSLocked) ReadAndHandle(handlers MsgHandlers) (err error) {
 	var msg MsgWrapper
 
 	_, r, err := handler.ws.NextReader()
@@ -87,25 +216,137 @@ func (handler *TTYProtocolWSLocked) ReadAndHandle(onWrite OnMsgWrite, onWinSize
 	case MsgIDWrite:
 		var msgWrite MsgTTYWrite
 		err = json.Unmarshal(msg.Data, &msgWrite)
-		if err == nil {
-			onWrite(msgWrite.Data)
+		if err == nil && handlers.OnWrite != nil {
+			handlers.OnWrite(msgWrite.Data)
 		}
 	case MsgIDWinSize:
 		var msgRemoteWinSize MsgTTYWinSize
 		err = json.Unmarshal(msg.Data, &msgRemoteWinSize)
-		if err == nil {
-			onWinSize(msgRemoteWinSize.Cols, msgRemoteWinSize.Rows)
+		if err == nil && handlers.OnWinSize != nil {
+			handlers.OnWinSize(msgRemoteWinSize.Cols, msgRemoteWinSize.Rows)
+		}
+	case MsgIDExit:
+		var msgExit MsgTTYExit
+		err = json.Unmarshal(msg.Data, &msgExit)
+		if err == nil && handlers.OnExit != nil {
+			handlers.OnExit(msgExit.Code, msgExit.Signal)
+		}
+	case MsgIDNotice:
+		var msgNotice MsgTTYNotice
+		err = json.Unmarshal(msg.Data, &msgNotice)
+		if err == nil && handlers.OnNotice != nil {
+			handlers.OnNotice(msgNotice.Text)
+		}
+	case MsgIDExtend:
+		if handlers.OnExtend != nil {
+			handlers.OnExtend()
+		}
+	case MsgIDRole:
+		var msgRole MsgTTYRole
+		err = json.Unmarshal(msg.Data, &msgRole)
+		if err == nil && handlers.OnRole != nil {
+			handlers.OnRole(msgRole.Role)
+		}
+	case MsgIDControl:
+		var msgControl MsgTTYControl
+		err = json.Unmarshal(msg.Data, &msgControl)
+		if err == nil && handlers.OnControl != nil {
+			handlers.OnControl(msgControl.Action, msgControl.Target)
+		}
+	case MsgIDDriver:
+		var msgDriver MsgTTYDriver
+		err = json.Unmarshal(msg.Data, &msgDriver)
+		if err == nil && handlers.OnDriver != nil {
+			handlers.OnDriver(msgDriver.Driver, msgDriver.You)
+		}
+	case MsgIDJoinRequests:
+		var msgRequests MsgTTYJoinRequests
+		err = json.Unmarshal(msg.Data, &msgRequests)
+		if err == nil && handlers.OnJoinRequests != nil {
+			handlers.OnJoinRequests(msgRequests.Requests)
+		}
+	case MsgIDJoinDecision:
+		var msgDecision MsgTTYJoinDecision
+		err = json.Unmarshal(msg.Data, &msgDecision)
+		if err == nil && handlers.OnJoinDecision != nil {
+			handlers.OnJoinDecision(msgDecision.ID, msgDecision.Approve)
+		}
+	case MsgIDJoinStatus:
+		var msgStatus MsgTTYJoinStatus
+		err = json.Unmarshal(msg.Data, &msgStatus)
+		if err == nil && handlers.OnJoinStatus != nil {
+			handlers.OnJoinStatus(msgStatus.Status, msgStatus.Reason)
 		}
 	}
 	return
 }
 
 func (handler *TTYProtocolWSLocked) SetWinSize(cols, rows int) (err error) {
-	msgWinChanged := MsgTTYWinSize{
+	return handler.writeMsg(MsgTTYWinSize{
 		Cols: cols,
 		Rows: rows,
-	}
-	data, err := marshalMsg(msgWinChanged)
+	})
+}
+
+func (handler *TTYProtocolWSLocked) Exit(code int, signal string) (err error) {
+	return handler.writeMsg(MsgTTYExit{
+		Code:   code,
+		Signal: signal,
+	})
+}
+
+func (handler *TTYProtocolWSLocked) Notice(text string) (err error) {
+	return handler.writeMsg(MsgTTYNotice{
+		Text: text,
+	})
+}
+
+func (handler *TTYProtocolWSLocked) Extend() (err error) {
+	return handler.writeMsg(MsgTTYExtend{})
+}
+
+func (handler *TTYProtocolWSLocked) SetRole(role Role) (err error) {
+	return handler.writeMsg(MsgTTYRole{
+		Role: role,
+	})
+}
+
+func (handler *TTYProtocolWSLocked) Control(action, target string) (err error) {
+	return handler.writeMsg(MsgTTYControl{
+		Action: action,
+		Target: target,
+	})
+}
+
+func (handler *TTYProtocolWSLocked) SetDriver(driver string, you bool) (err error) {
+	return handler.writeMsg(MsgTTYDriver{
+		Driver: driver,
+		You:    you,
+	})
+}
+
+func (handler *TTYProtocolWSLocked) SetJoinRequests(requests []JoinRequest) (err error) {
+	return handler.writeMsg(MsgTTYJoinRequests{
+		Requests: requests,
+	})
+}
+
+func (handler *TTYProtocolWSLocked) DecideJoin(id string, approve bool) (err error) {
+	return handler.writeMsg(MsgTTYJoinDecision{
+		ID:      id,
+		Approve: approve,
+	})
+}
+
+func (handler *TTYProtocolWSLocked) SetJoinStatus(status, reason string) (err error) {
+	return handler.writeMsg(MsgTTYJoinStatus{
+		Status: status,
+		Reason: reason,
+	})
+}
+
+func (handler *TTYProtocolWSLocked) writeMsg(aMessage interface{}) (err error) {
+	data, err := marshalMsg(aMessage)
 	if err != nil {
 		return
 	}